@@ -114,7 +114,7 @@ func (s *DockerRegistryAuthHtpasswdSuite) SetUpTest(c *check.C) {
 
 func (s *DockerRegistryAuthHtpasswdSuite) TearDownTest(c *check.C) {
 	if s.reg != nil {
-		out, err := s.d.Cmd("logout", privateRegistryURL)
+		out, _, err := dockerCmdWithError("logout", privateRegistryURL)
 		c.Assert(err, check.IsNil, check.Commentf(out))
 		s.reg.Close()
 	}
@@ -143,7 +143,7 @@ func (s *DockerRegistryAuthTokenSuite) SetUpTest(c *check.C) {
 
 func (s *DockerRegistryAuthTokenSuite) TearDownTest(c *check.C) {
 	if s.reg != nil {
-		out, err := s.d.Cmd("logout", privateRegistryURL)
+		out, _, err := dockerCmdWithError("logout", privateRegistryURL)
 		c.Assert(err, check.IsNil, check.Commentf(out))
 		s.reg.Close()
 	}
@@ -171,6 +171,13 @@ type DockerDaemonSuite struct {
 	d  *Daemon
 }
 
+func (s *DockerDaemonSuite) SetUpSuite(c *check.C) {
+	err := removeOrphanedDaemonFolders(daemonsDir(), orphanedDaemonFolderAge)
+	if err != nil && !os.IsNotExist(err) {
+		c.Fatalf("could not remove orphaned daemon directories: %v", err)
+	}
+}
+
 func (s *DockerDaemonSuite) SetUpTest(c *check.C) {
 	testRequires(c, DaemonIsLinux)
 	s.d = NewDaemon(c)
@@ -1,24 +1,50 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/opts"
+	"github.com/docker/docker/pkg/aaparser"
 	"github.com/docker/docker/pkg/integration/checker"
 	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/docker/pkg/tlsconfig"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/docker/docker/reference"
+	"github.com/docker/docker/registry"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	eventtypes "github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/go-connections/sockets"
 	"github.com/go-check/check"
+	"golang.org/x/net/context"
 )
 
 // Daemon represents a Docker daemon for the testing framework.
@@ -27,13 +53,98 @@ type Daemon struct {
 	// Useful to set to --daemon or -d for checking backwards compatibility
 	Command     string
 	GlobalFlags []string
+	// TLSOptions are the client TLS settings used to talk to a daemon
+	// listening on the default TLS host. Defaults to the certificates in
+	// fixtures/https.
+	TLSOptions *tlsconfig.Options
+	// StopTimeout is how long Stop waits for the daemon to exit after
+	// interrupting it before killing it. Defaults to defaultStopTimeout.
+	StopTimeout time.Duration
+	// KeepFolderOnFailure makes Cleanup leave the daemon directory in place
+	// when the test has failed, so it can be inspected.
+	KeepFolderOnFailure bool
+	// Experimental requires the daemon to be an experimental build.
+	// Experimental features are compiled into the binary rather than
+	// enabled by a flag, so Start fails if the daemon is not one.
+	Experimental bool
+	// CgroupDriver is passed to the daemon as native.cgroupdriver exec-opt
+	// when set, e.g. "cgroupfs" or "systemd".
+	CgroupDriver string
+	// BridgeName is passed to the daemon as --bridge when set. The daemon
+	// does not create the bridge, it has to exist before Start is called
+	// (see createInterface).
+	BridgeName string
+	// BridgeMTU is passed to the daemon as --mtu when set.
+	BridgeMTU int
+	// BIP is passed to the daemon as --bip when set.
+	BIP string
+	// ManageIptables is passed to the daemon as --iptables when set, to
+	// enable or disable the iptables rules it adds.
+	ManageIptables *bool
+	// ExtraHosts are passed to the daemon as additional --host flags. The
+	// harness keeps talking to the daemon over its primary socket.
+	ExtraHosts []string
+	// InsecureRegistries are passed to the daemon as --insecure-registry.
+	// Each is a host with an optional port, or a CIDR.
+	InsecureRegistries []string
+	// RegistryMirrors are passed to the daemon as --registry-mirror. Each
+	// is an http or https URL without a path.
+	RegistryMirrors []string
+	// Labels are passed to the daemon as --label engine labels, which are
+	// reported in Info().Labels. Each has to be in key=value form.
+	Labels []string
+	// MaxConcurrentDownloads and MaxConcurrentUploads are passed to the
+	// daemon as --max-concurrent-downloads and --max-concurrent-uploads
+	// when not 0, limiting the layers transferred at once per pull or push.
+	MaxConcurrentDownloads int
+	MaxConcurrentUploads   int
+	// DNS and DNSSearch are passed to the daemon as --dns and --dns-search,
+	// the nameservers and search domains of containers that don't set
+	// their own.
+	DNS       []string
+	DNSSearch []string
+	// UsernsRemap is passed to the daemon as --userns-remap when set, e.g.
+	// "default" or "user:group", to run containers in a user namespace with
+	// root mapped to an unprivileged host user. NewDaemon sets it from
+	// DOCKER_REMAP_ROOT.
+	UsernsRemap string
+	// LogDriver is passed to the daemon as --log-driver when set, and
+	// LogOpts as --log-opt key=value.
+	LogDriver string
+	LogOpts   map[string]string
+	// StorageOpts are passed to the daemon as --storage-opt, e.g.
+	// "dm.basesize=20G".
+	StorageOpts []string
+	// DefaultUlimits are passed to the daemon as --default-ulimit, e.g.
+	// "nofile=1024:2048".
+	DefaultUlimits []string
+	// Rlimits are set for the daemon process before it executes, so they
+	// are inherited by the processes it starts but do not affect the test
+	// process. Linux only.
+	Rlimits []Rlimit
+	// ProxyConfig sets the proxy environment of the daemon process, which
+	// it uses to reach registries. It does not apply to containers.
+	ProxyConfig ProxyConfig
+	// ReadyFunc, when set, has to succeed in addition to /_ping before
+	// Start considers the daemon ready. It is retried until the startup
+	// timeout.
+	ReadyFunc func(*Daemon) error
+	// ConfigDir is the CLI configuration directory used by Cmd, which holds
+	// config.json. It defaults to a directory in the daemon folder, so that
+	// daemons do not share credentials or CLI settings.
+	ConfigDir string
+	// APIVersion pins the API version used by APICall and Cmd, e.g. "1.20",
+	// to test how the daemon answers older clients. Defaults to the latest.
+	APIVersion string
+	// NoForceDebug keeps Start from adding --debug when no debug or
+	// log-level flag is passed, so the daemon logs at its default level.
+	NoForceDebug bool
 
 	id                string
 	c                 *check.C
 	logFile           *os.File
+	keepLogFile       bool
 	folder            string
-	root              string
-	stdin             io.WriteCloser
 	stdout, stderr    io.ReadCloser
 	cmd               *exec.Cmd
 	storageDriver     string
@@ -41,6 +152,141 @@ type Daemon struct {
 	userlandProxy     bool
 	useDefaultHost    bool
 	useDefaultTLSHost bool
+	tcpBindAddr       string
+	ipv6CIDR          string
+	version           *types.Version
+	exitState         *os.ProcessState
+	killed            bool
+	stopPanicWatch    chan struct{}
+	startupDuration   time.Duration
+	logStart          int64
+	debugReset        bool
+	cleanups          []func() error
+	stopSampler       chan struct{}
+	samplerDone       chan struct{}
+
+	// mu guards the fields below, which change when the daemon is
+	// (re)started while other goroutines may be running commands against it.
+	mu       sync.RWMutex
+	root     string
+	tcpAddr  string
+	panicMsg string
+	samples  []ResourceSample
+}
+
+// defaultStopTimeout leaves the daemon time for stopping containers and
+// running its shutdown hooks.
+const defaultStopTimeout = 20 * time.Second
+
+// tcpPortRetries is the number of ports a TCP daemon is tried on before
+// giving up. A probed port can be taken by someone else before the daemon
+// gets to bind it, in which case the daemon exits during startup.
+const tcpPortRetries = 3
+
+// apiVersionRegexp matches the values accepted for Daemon.APIVersion.
+var apiVersionRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// errDaemonKilled is returned by WaitExit when the daemon did not exit on
+// its own but had to be killed.
+var errDaemonKilled = errors.New("daemon was killed")
+
+var (
+	// errImageNotFound is the cause of a registryError when the registry
+	// does not have the requested image.
+	errImageNotFound = errors.New("image not found")
+	// errRegistryUnreachable is the cause of a registryError when the
+	// registry could not be contacted.
+	errRegistryUnreachable = errors.New("registry unreachable")
+)
+
+// registryError is returned by PullImage and PushImage when the CLI fails.
+type registryError struct {
+	// cause is errImageNotFound, errRegistryUnreachable or nil if the
+	// failure could not be classified.
+	cause error
+	out   string
+}
+
+func (e registryError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%v: %s", e.cause, e.out)
+	}
+	return e.out
+}
+
+func newRegistryError(out string) registryError {
+	var cause error
+	switch {
+	case strings.Contains(out, "not found"), strings.Contains(out, "manifest unknown"):
+		cause = errImageNotFound
+	case strings.Contains(out, "connection refused"), strings.Contains(out, "no such host"), strings.Contains(out, "i/o timeout"):
+		cause = errRegistryUnreachable
+	}
+	return registryError{cause: cause, out: strings.TrimSpace(out)}
+}
+
+// maxParallelDaemonStarts bounds how many daemons StartDaemons starts at
+// the same time.
+const maxParallelDaemonStarts = 4
+
+// panicMarkers start the log lines of a crashing daemon.
+var panicMarkers = []string{"panic:", "fatal error:", "runtime error:"}
+
+// errorLogLines is the number of log lines included in startup and shutdown
+// failure messages.
+const errorLogLines = 20
+
+// maxPanicLines bounds how much of a panic HasPanicked reports.
+const maxPanicLines = 50
+
+// daemonExitedError is returned when the daemon process exits before it
+// starts answering requests. It includes the end of the daemon log, which
+// holds the reason the daemon refused to start.
+type daemonExitedError struct {
+	id      string
+	logTail string
+}
+
+func (e daemonExitedError) Error() string {
+	return fmt.Sprintf("[%s] Daemon exited during startup%s", e.id, e.logTail)
+}
+
+// ProxyConfig is the proxy environment of a daemon process.
+type ProxyConfig struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy string
+}
+
+// env returns environ with the proxy variables replaced by the ones of p.
+// Both the lower and the upper case variants are set, as either may be
+// used.
+func (p ProxyConfig) env(environ []string) []string {
+	vars := map[string]string{
+		"http_proxy":  p.HTTP,
+		"https_proxy": p.HTTPS,
+		"no_proxy":    p.NoProxy,
+	}
+	var env []string
+	for _, e := range environ {
+		name := strings.ToLower(strings.SplitN(e, "=", 2)[0])
+		if _, ok := vars[name]; !ok {
+			env = append(env, e)
+		}
+	}
+	for name, value := range vars {
+		if value != "" {
+			env = append(env, name+"="+value, strings.ToUpper(name)+"="+value)
+		}
+	}
+	return env
+}
+
+// Rlimit is a resource limit, see setrlimit(2). Resource is one of the
+// RLIMIT_* constants of the syscall package.
+type Rlimit struct {
+	Resource   int
+	Soft, Hard uint64
 }
 
 type clientConfig struct {
@@ -49,12 +295,59 @@ type clientConfig struct {
 	addr      string
 }
 
+// pingStatusError is returned by ping when the daemon answered with a
+// status other than 200 OK, e.g. while it is still initializing.
+type pingStatusError struct {
+	status string
+}
+
+func (e pingStatusError) Error() string {
+	return fmt.Sprintf("received status != 200 OK: %s", e.status)
+}
+
+// ping requests /_ping and succeeds only on a 200 OK response.
+func (c *clientConfig) ping() error {
+	client := &http.Client{
+		Transport: c.transport,
+	}
+
+	req, err := http.NewRequest("GET", "/_ping", nil)
+	if err != nil {
+		return fmt.Errorf("could not create new request: %v", err)
+	}
+	req.URL.Host = c.addr
+	req.URL.Scheme = c.scheme
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so the connection is released
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pingStatusError{resp.Status}
+	}
+	return nil
+}
+
+// daemonsDir returns the directory NewDaemon creates the daemon directories
+// in, $DEST or a docker-integration folder in the temporary directory.
+func daemonsDir() string {
+	if dest := os.Getenv("DEST"); dest != "" {
+		return dest
+	}
+	return filepath.Join(os.TempDir(), "docker-integration")
+}
+
 // NewDaemon returns a Daemon instance to be used for testing.
-// This will create a directory such as d123456789 in the folder specified by $DEST.
+// This will create a directory such as d123456789 in the folder specified by $DEST,
+// or in a docker-integration folder in the temporary directory if $DEST is not set.
 // The daemon will not automatically start.
 func NewDaemon(c *check.C) *Daemon {
-	dest := os.Getenv("DEST")
-	c.Assert(dest, check.Not(check.Equals), "", check.Commentf("Please set the DEST environment variable"))
+	dest := daemonsDir()
+	if os.Getenv("DEST") == "" {
+		c.Logf("WARNING: DEST is not set, creating daemon directories in %s", dest)
+	}
 
 	id := fmt.Sprintf("d%d", time.Now().UnixNano()%100000000)
 	dir := filepath.Join(dest, id)
@@ -75,13 +368,38 @@ func NewDaemon(c *check.C) *Daemon {
 		Command:       "daemon",
 		id:            id,
 		c:             c,
+		ConfigDir:     filepath.Join(daemonFolder, "cli-config"),
 		folder:        daemonFolder,
 		root:          daemonRoot,
+		UsernsRemap:   os.Getenv("DOCKER_REMAP_ROOT"),
 		storageDriver: os.Getenv("DOCKER_GRAPHDRIVER"),
 		userlandProxy: userlandProxy,
 	}
 }
 
+// ForEachStorageDriver runs fn against a new daemon with busybox loaded for
+// every driver in drivers. Drivers the host does not support are skipped.
+// Each daemon is cleaned up after fn returns.
+func ForEachStorageDriver(c *check.C, drivers []string, fn func(d *Daemon)) {
+	for _, driver := range drivers {
+		d := NewDaemon(c)
+		d.storageDriver = driver
+		if err := d.StartWithBusybox(); err != nil {
+			log, _ := ioutil.ReadFile(filepath.Join(d.folder, "docker.log"))
+			d.Cleanup()
+			if bytes.Contains(log, []byte(graphdriver.ErrNotSupported.Error())) || bytes.Contains(log, []byte(graphdriver.ErrPrerequisites.Error())) {
+				c.Logf("[%s] skipping unsupported storage driver %s", d.id, driver)
+				continue
+			}
+			c.Fatalf("[%s] could not start daemon with storage driver %s: %v", d.id, driver, err)
+		}
+		func() {
+			defer d.Cleanup()
+			fn(d)
+		}()
+	}
+}
+
 func (d *Daemon) getClientConfig() (*clientConfig, error) {
 	var (
 		transport *http.Transport
@@ -89,11 +407,18 @@ func (d *Daemon) getClientConfig() (*clientConfig, error) {
 		addr      string
 		proto     string
 	)
+	d.mu.RLock()
+	tcpAddr := d.tcpAddr
+	d.mu.RUnlock()
+
 	if d.useDefaultTLSHost {
-		option := &tlsconfig.Options{
-			CAFile:   "fixtures/https/ca.pem",
-			CertFile: "fixtures/https/client-cert.pem",
-			KeyFile:  "fixtures/https/client-key.pem",
+		option := d.TLSOptions
+		if option == nil {
+			option = &tlsconfig.Options{
+				CAFile:   "fixtures/https/ca.pem",
+				CertFile: "fixtures/https/client-cert.pem",
+				KeyFile:  "fixtures/https/client-key.pem",
+			}
 		}
 		tlsConfig, err := tlsconfig.Client(*option)
 		if err != nil {
@@ -105,14 +430,18 @@ func (d *Daemon) getClientConfig() (*clientConfig, error) {
 		addr = fmt.Sprintf("%s:%d", opts.DefaultHTTPHost, opts.DefaultTLSHTTPPort)
 		scheme = "https"
 		proto = "tcp"
+	} else if tcpAddr != "" {
+		addr = tcpAddr
+		proto = "tcp"
+		scheme = "http"
+		transport = &http.Transport{}
 	} else if d.useDefaultHost {
 		addr = opts.DefaultUnixSocket
 		proto = "unix"
 		scheme = "http"
 		transport = &http.Transport{}
 	} else {
-		addr = filepath.Join(d.folder, "docker.sock")
-		proto = "unix"
+		proto, addr = d.defaultSock()
 		scheme = "http"
 		transport = &http.Transport{}
 	}
@@ -135,15 +464,71 @@ func (d *Daemon) Start(args ...string) error {
 	return d.StartWithLogFile(logFile, args...)
 }
 
+// UseTCP makes the daemon listen on a free TCP port of bindAddr instead of
+// the unix socket in its folder. The port is picked when the daemon starts.
+func (d *Daemon) UseTCP(bindAddr string) {
+	d.tcpBindAddr = bindAddr
+}
+
+// EnableIPv6 makes the daemon enable IPv6 on the default bridge and assign
+// container addresses out of cidr when it starts.
+func (d *Daemon) EnableIPv6(cidr string) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("[%s] invalid IPv6 CIDR %q: %v", d.id, cidr, err)
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("[%s] invalid IPv6 CIDR %q: not an IPv6 prefix", d.id, cidr)
+	}
+	d.ipv6CIDR = cidr
+	return nil
+}
+
 // StartWithLogFile will start the daemon and attach its streams to a given file.
 func (d *Daemon) StartWithLogFile(out *os.File, providedArgs ...string) error {
+	if d.tcpBindAddr == "" {
+		return d.startWithLogFile(out, providedArgs...)
+	}
+
+	for i := 0; i < tcpPortRetries; i++ {
+		addr, err := freeTCPAddr(d.tcpBindAddr)
+		if err != nil {
+			return fmt.Errorf("[%s] could not allocate a TCP port on %s: %v", d.id, d.tcpBindAddr, err)
+		}
+		d.mu.Lock()
+		d.tcpAddr = addr
+		d.mu.Unlock()
+
+		err = d.startWithLogFile(out, providedArgs...)
+		if _, ok := err.(daemonExitedError); !ok || i == tcpPortRetries-1 || !d.lostPortRace() {
+			return err
+		}
+		d.c.Logf("[%s] port %s was taken before the daemon started, retrying with another port", d.id, addr)
+	}
+	return nil
+}
+
+// lostPortRace returns whether the daemon exited because another process
+// bound the port freeTCPAddr found before the daemon could.
+func (d *Daemon) lostPortRace() bool {
+	content, err := d.logSinceStart()
+	return err == nil && bytes.Contains(content, []byte("address already in use"))
+}
+
+func (d *Daemon) startWithLogFile(out *os.File, providedArgs ...string) error {
+	d.version = nil
+	d.exitState = nil
+	d.killed = false
+	d.startupDuration = 0
+	d.debugReset = false
+
 	dockerBinary, err := exec.LookPath(dockerBinary)
 	d.c.Assert(err, check.IsNil, check.Commentf("[%s] could not find docker binary in $PATH", d.id))
 
 	args := append(d.GlobalFlags,
 		d.Command,
 		"--containerd", "/var/run/docker/libcontainerd/docker-containerd.sock",
-		"--graph", d.root,
+		"--graph", d.baseRoot(),
 		"--exec-root", filepath.Join(d.folder, "exec-root"),
 		"--pidfile", fmt.Sprintf("%s/docker.pid", d.folder),
 		fmt.Sprintf("--userland-proxy=%t", d.userlandProxy),
@@ -151,8 +536,79 @@ func (d *Daemon) StartWithLogFile(out *os.File, providedArgs ...string) error {
 	if !(d.useDefaultHost || d.useDefaultTLSHost) {
 		args = append(args, []string{"--host", d.sock()}...)
 	}
-	if root := os.Getenv("DOCKER_REMAP_ROOT"); root != "" {
-		args = append(args, []string{"--userns-remap", root}...)
+	for _, h := range d.ExtraHosts {
+		if _, err := opts.ValidateHost(h); err != nil {
+			return fmt.Errorf("[%s] invalid extra host %q: %v", d.id, h, err)
+		}
+		args = append(args, "--host", h)
+	}
+	if d.UsernsRemap != "" {
+		args = append(args, "--userns-remap", d.UsernsRemap)
+	}
+	if d.ipv6CIDR != "" {
+		args = append(args, "--ipv6", "--fixed-cidr-v6="+d.ipv6CIDR)
+	}
+	if d.BridgeName != "" {
+		args = append(args, "--bridge", d.BridgeName)
+	}
+	if d.BridgeMTU != 0 {
+		args = append(args, "--mtu", strconv.Itoa(d.BridgeMTU))
+	}
+	if d.BIP != "" {
+		args = append(args, "--bip", d.BIP)
+	}
+	if d.ManageIptables != nil {
+		args = append(args, "--iptables="+strconv.FormatBool(*d.ManageIptables))
+	}
+	if d.CgroupDriver != "" {
+		args = append(args, "--exec-opt", "native.cgroupdriver="+d.CgroupDriver)
+	}
+	for _, r := range d.InsecureRegistries {
+		if err := validateInsecureRegistry(r); err != nil {
+			return fmt.Errorf("[%s] invalid insecure registry %q: %v", d.id, r, err)
+		}
+		args = append(args, "--insecure-registry", r)
+	}
+	for _, m := range d.RegistryMirrors {
+		if _, err := registry.ValidateMirror(m); err != nil {
+			return fmt.Errorf("[%s] invalid registry mirror %q: %v", d.id, m, err)
+		}
+		args = append(args, "--registry-mirror", m)
+	}
+	for _, l := range d.Labels {
+		if _, err := opts.ValidateLabel(l); err != nil || strings.HasPrefix(l, "=") {
+			return fmt.Errorf("[%s] invalid label %q, expected key=value", d.id, l)
+		}
+		args = append(args, "--label", l)
+	}
+	if d.MaxConcurrentDownloads != 0 {
+		args = append(args, "--max-concurrent-downloads", strconv.Itoa(d.MaxConcurrentDownloads))
+	}
+	if d.MaxConcurrentUploads != 0 {
+		args = append(args, "--max-concurrent-uploads", strconv.Itoa(d.MaxConcurrentUploads))
+	}
+	for _, ns := range d.DNS {
+		if _, err := opts.ValidateIPAddress(ns); err != nil {
+			return fmt.Errorf("[%s] invalid DNS server %q: %v", d.id, ns, err)
+		}
+		args = append(args, "--dns", ns)
+	}
+	for _, domain := range d.DNSSearch {
+		if _, err := opts.ValidateDNSSearch(domain); err != nil {
+			return fmt.Errorf("[%s] invalid DNS search domain %q: %v", d.id, domain, err)
+		}
+		args = append(args, "--dns-search", domain)
+	}
+	if d.LogDriver != "" {
+		args = append(args, "--log-driver", d.LogDriver)
+	}
+	logOpts := make([]string, 0, len(d.LogOpts))
+	for k, v := range d.LogOpts {
+		logOpts = append(logOpts, k+"="+v)
+	}
+	sort.Strings(logOpts)
+	for _, o := range logOpts {
+		args = append(args, "--log-opt", o)
 	}
 
 	// If we don't explicitly set the log-level or debug flag(-D) then
@@ -160,27 +616,55 @@ func (d *Daemon) StartWithLogFile(out *os.File, providedArgs ...string) error {
 	foundLog := false
 	foundSd := false
 	for _, a := range providedArgs {
-		if strings.Contains(a, "--log-level") || strings.Contains(a, "-D") || strings.Contains(a, "--debug") {
+		if isFlag(a, "-l", "--log-level", "-D", "--debug") {
 			foundLog = true
 		}
 		if strings.Contains(a, "--storage-driver") {
 			foundSd = true
 		}
 	}
-	if !foundLog {
+	if !foundLog && !d.NoForceDebug {
 		args = append(args, "--debug")
 	}
 	if d.storageDriver != "" && !foundSd {
 		args = append(args, "--storage-driver", d.storageDriver)
 	}
+	for _, o := range d.StorageOpts {
+		args = append(args, "--storage-opt", o)
+	}
+	for _, u := range d.DefaultUlimits {
+		args = append(args, "--default-ulimit", u)
+	}
 
 	args = append(args, providedArgs...)
 	d.cmd = exec.Command(dockerBinary, args...)
+	if err := d.setRlimits(d.cmd); err != nil {
+		return fmt.Errorf("[%s] could not set resource limits: %v", d.id, err)
+	}
+	if d.ProxyConfig != (ProxyConfig{}) {
+		d.cmd.Env = d.ProxyConfig.env(os.Environ())
+	}
 
 	d.cmd.Stdout = out
 	d.cmd.Stderr = out
 	d.logFile = out
 
+	d.mu.Lock()
+	d.panicMsg = ""
+	d.mu.Unlock()
+	d.stopPanicWatch = make(chan struct{})
+	if err := d.watchForPanics(out.Name(), d.stopPanicWatch); err != nil {
+		d.c.Logf("[%s] not watching %s for panics: %v", d.id, out.Name(), err)
+	}
+
+	// the log file is appended to, this start is logged from its end on
+	fi, err := out.Stat()
+	if err != nil {
+		return fmt.Errorf("[%s] could not stat log file: %v", d.id, err)
+	}
+	d.logStart = fi.Size()
+
+	launched := time.Now()
 	if err := d.cmd.Start(); err != nil {
 		return fmt.Errorf("[%s] could not start daemon container: %v", d.id, err)
 	}
@@ -198,263 +682,2688 @@ func (d *Daemon) StartWithLogFile(out *os.File, providedArgs ...string) error {
 	tick := time.Tick(500 * time.Millisecond)
 	// make sure daemon is ready to receive requests
 	startTime := time.Now().Unix()
+	var notReady error
 	for {
 		d.c.Logf("[%s] waiting for daemon to start", d.id)
 		if time.Now().Unix()-startTime > 5 {
 			// After 5 seconds, give up
-			return fmt.Errorf("[%s] Daemon exited and never started", d.id)
+			if notReady != nil {
+				return fmt.Errorf("[%s] daemon never became ready: %v%s", d.id, notReady, d.logTail())
+			}
+			return fmt.Errorf("[%s] Daemon exited and never started%s", d.id, d.logTail())
 		}
 		select {
 		case <-time.After(2 * time.Second):
-			return fmt.Errorf("[%s] timeout: daemon does not respond", d.id)
+			return fmt.Errorf("[%s] timeout: daemon does not respond%s", d.id, d.logTail())
 		case <-tick:
 			clientConfig, err := d.getClientConfig()
 			if err != nil {
 				return err
 			}
 
-			client := &http.Client{
-				Transport: clientConfig.transport,
-			}
-
-			req, err := http.NewRequest("GET", "/_ping", nil)
-			d.c.Assert(err, check.IsNil, check.Commentf("[%s] could not create new request", d.id))
-			req.URL.Host = clientConfig.addr
-			req.URL.Scheme = clientConfig.scheme
-			resp, err := client.Do(req)
+			err = clientConfig.ping()
+			// the transport is not used for anything else
+			clientConfig.transport.CloseIdleConnections()
 			if err != nil {
+				if _, ok := err.(pingStatusError); ok {
+					d.c.Logf("[%s] %v", d.id, err)
+				}
 				continue
 			}
-			if resp.StatusCode != http.StatusOK {
-				d.c.Logf("[%s] received status != 200 OK: %s", d.id, resp.Status)
+			if d.ReadyFunc != nil {
+				if notReady = d.ReadyFunc(d); notReady != nil {
+					d.c.Logf("[%s] daemon not ready yet: %v", d.id, notReady)
+					continue
+				}
 			}
-			d.c.Logf("[%s] daemon started", d.id)
-			d.root, err = d.queryRootDir()
+			d.startupDuration = time.Since(launched)
+			d.c.Logf("[%s] daemon started in %v", d.id, d.startupDuration)
+			root, err := d.queryRootDir()
+			d.mu.Lock()
+			d.root = root
+			d.mu.Unlock()
 			if err != nil {
 				return fmt.Errorf("[%s] error querying daemon for root directory: %v", d.id, err)
 			}
+			if d.Experimental && !d.SupportsExperimental() {
+				return fmt.Errorf("[%s] daemon is not an experimental build", d.id)
+			}
 			return nil
 		case <-d.wait:
-			return fmt.Errorf("[%s] Daemon exited during startup", d.id)
+			return daemonExitedError{d.id, d.logTail()}
 		}
 	}
 }
 
-// StartWithBusybox will first start the daemon with Daemon.Start()
-// then save the busybox image from the main daemon and load it into this Daemon instance.
-func (d *Daemon) StartWithBusybox(arg ...string) error {
-	if err := d.Start(arg...); err != nil {
-		return err
-	}
-	return d.LoadBusybox()
+// StartupDuration returns how long the last successful start took from
+// launching the daemon process until it answered /_ping and ReadyFunc.
+func (d *Daemon) StartupDuration() time.Duration {
+	return d.startupDuration
 }
 
-// Kill will send a SIGKILL to the daemon
-func (d *Daemon) Kill() error {
-	if d.cmd == nil || d.wait == nil {
-		return errors.New("daemon not started")
+// isFlag returns whether arg is one of the named flags, with or without an
+// inline value. Both a single and a double dash are accepted.
+func isFlag(arg string, names ...string) bool {
+	if i := strings.Index(arg, "="); i >= 0 {
+		arg = arg[:i]
+	}
+	arg = "-" + strings.TrimLeft(arg, "-")
+	for _, name := range names {
+		if arg == "-"+strings.TrimLeft(name, "-") {
+			return true
+		}
 	}
+	return false
+}
 
-	defer func() {
-		d.logFile.Close()
-		d.cmd = nil
-	}()
+// startupPhases lists the phases reported by StartTimings in startup order,
+// each with the log message that ends it.
+var startupPhases = []struct {
+	name, marker string
+}{
+	{"containerd", "New containerd process"},
+	{"graphdriver", "Graph migration to content-addressability took"},
+	{"daemon", "Daemon has completed initialization"},
+	{"api", "API listen on"},
+}
 
-	if err := d.cmd.Process.Kill(); err != nil {
-		d.c.Logf("Could not kill daemon: %v", err)
-		return err
-	}
+var (
+	logTimeRegexp = regexp.MustCompile(`(?:^|\s)time="([^"]+)"`)
+	logMsgRegexp  = regexp.MustCompile(`(?:^|\s)msg="((?:[^"\\]|\\.)*)"`)
+)
 
-	if err := os.Remove(fmt.Sprintf("%s/docker.pid", d.folder)); err != nil {
-		return err
+// StartTimings breaks the last start of the daemon down into phases, using
+// the timestamps of its log. A phase lasts from the end of the previous phase
+// found in the log, or from the first log line, until its own end. Phases
+// whose end is not logged are left out, and "total" covers all of them.
+// Both the text and the JSON log format are understood.
+func (d *Daemon) StartTimings() (map[string]time.Duration, error) {
+	f, err := os.Open(d.logPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(d.logStart, os.SEEK_SET); err != nil {
+		return nil, err
 	}
 
-	return nil
+	var (
+		timings    = make(map[string]time.Duration)
+		first, end time.Time
+		next       int
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() && next < len(startupPhases) {
+		t, msg, ok := parseLogLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if first.IsZero() {
+			first, end = t, t
+		}
+		for i := next; i < len(startupPhases); i++ {
+			if strings.Contains(msg, startupPhases[i].marker) {
+				timings[startupPhases[i].name] = t.Sub(end)
+				end, next = t, i+1
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(timings) == 0 {
+		return nil, fmt.Errorf("[%s] no startup phases found in %s", d.id, d.logPath())
+	}
+	timings["total"] = end.Sub(first)
+	return timings, nil
 }
 
-// Stop will send a SIGINT every second and wait for the daemon to stop.
-// If it timeouts, a SIGKILL is sent.
-// Stop will not delete the daemon directory. If a purged daemon is needed,
-// instantiate a new one with NewDaemon.
-func (d *Daemon) Stop() error {
-	if d.cmd == nil || d.wait == nil {
-		return errors.New("daemon not started")
+// parseLogLine returns the time and message of a daemon log line in the text
+// or the JSON log format.
+func parseLogLine(line string) (time.Time, string, bool) {
+	var ts, msg string
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Time string `json:"time"`
+			Msg  string `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return time.Time{}, "", false
+		}
+		ts, msg = entry.Time, entry.Msg
+	} else {
+		m := logTimeRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return time.Time{}, "", false
+		}
+		ts = m[1]
+		if m := logMsgRegexp.FindStringSubmatch(line); m != nil {
+			msg = m[1]
+		}
 	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return t, msg, true
+}
 
-	defer func() {
-		d.logFile.Close()
-		d.cmd = nil
-	}()
-
-	i := 1
-	tick := time.Tick(time.Second)
-
-	if err := d.cmd.Process.Signal(os.Interrupt); err != nil {
-		return fmt.Errorf("could not send signal: %v", err)
+// validateInsecureRegistry checks that r is a host with an optional port,
+// or a CIDR.
+func validateInsecureRegistry(r string) error {
+	if strings.Contains(r, "://") {
+		return errors.New("must not contain a scheme")
 	}
-out1:
-	for {
-		select {
-		case err := <-d.wait:
-			return err
-		case <-time.After(15 * time.Second):
-			// time for stopping jobs and run onShutdown hooks
-			d.c.Log("timeout")
-			break out1
-		}
+	if _, _, err := net.ParseCIDR(r); err == nil {
+		return nil
 	}
-
-out2:
-	for {
-		select {
-		case err := <-d.wait:
+	host := r
+	if strings.Contains(r, ":") {
+		var err error
+		if host, _, err = net.SplitHostPort(r); err != nil {
 			return err
-		case <-tick:
-			i++
-			if i > 4 {
-				d.c.Logf("tried to interrupt daemon for %d times, now try to kill it", i)
-				break out2
-			}
-			d.c.Logf("Attempt #%d: daemon is still running with pid %d", i, d.cmd.Process.Pid)
-			if err := d.cmd.Process.Signal(os.Interrupt); err != nil {
-				return fmt.Errorf("could not send signal: %v", err)
-			}
 		}
 	}
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return errors.New("must be a host with an optional port, or a CIDR")
+	}
+	return nil
+}
 
-	if err := d.cmd.Process.Kill(); err != nil {
-		d.c.Logf("Could not kill daemon: %v", err)
+// reloadTimeout is how long UpdateConfig waits for the daemon to reload its
+// configuration.
+const reloadTimeout = 10 * time.Second
+
+// StartWithConfig writes config to daemon.json in the daemon folder and
+// starts the daemon with it as --config-file, followed by args. The daemon
+// refuses to start if an option is set both in the file and as a flag; the
+// error then includes the reason it logged. Start does not add --debug or
+// --storage-driver when the file sets the log level or storage driver.
+func (d *Daemon) StartWithConfig(config map[string]interface{}, args ...string) error {
+	b, err := json.Marshal(config)
+	if err != nil {
 		return err
 	}
-
-	if err := os.Remove(fmt.Sprintf("%s/docker.pid", d.folder)); err != nil {
+	path := filepath.Join(d.folder, "daemon.json")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
 		return err
 	}
 
-	return nil
+	noForceDebug, storageDriver := d.NoForceDebug, d.storageDriver
+	defer func() {
+		d.NoForceDebug, d.storageDriver = noForceDebug, storageDriver
+	}()
+	if _, ok := config["debug"]; ok {
+		d.NoForceDebug = true
+	}
+	if _, ok := config["log-level"]; ok {
+		d.NoForceDebug = true
+	}
+	if _, ok := config["storage-driver"]; ok {
+		d.storageDriver = ""
+	}
+	return d.Start(append([]string{"--config-file", path}, args...)...)
 }
 
-// Restart will restart the daemon by first stopping it and then starting it.
-func (d *Daemon) Restart(arg ...string) error {
-	d.Stop()
-	// in the case of tests running a user namespace-enabled daemon, we have resolved
-	// d.root to be the actual final path of the graph dir after the "uid.gid" of
-	// remapped root is added--we need to subtract it from the path before calling
-	// start or else we will continue making subdirectories rather than truly restarting
-	// with the same location/root:
-	if root := os.Getenv("DOCKER_REMAP_ROOT"); root != "" {
-		d.root = filepath.Dir(d.root)
+// UpdateConfig merges changes into the configuration file the daemon was
+// started with, a nil value removing the key, and makes the daemon reload
+// it. It returns once the daemon has reloaded, or with the error the daemon
+// logged if it rejected the new configuration.
+func (d *Daemon) UpdateConfig(changes map[string]interface{}) error {
+	if d.cmd == nil {
+		return errors.New("daemon not started")
+	}
+	path := d.configFile()
+	if path == "" {
+		return fmt.Errorf("[%s] daemon was not started with --config-file", d.id)
 	}
-	return d.Start(arg...)
-}
 
-// LoadBusybox will load the stored busybox into a newly started daemon
-func (d *Daemon) LoadBusybox() error {
-	bb := filepath.Join(d.folder, "busybox.tar")
-	if _, err := os.Stat(bb); err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("unexpected error on busybox.tar stat: %v", err)
+	config := map[string]interface{}{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("[%s] invalid configuration file %s: %v", d.id, path, err)
 		}
-		// saving busybox image from main daemon
-		if err := exec.Command(dockerBinary, "save", "--output", bb, "busybox:latest").Run(); err != nil {
-			return fmt.Errorf("could not save busybox image: %v", err)
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(config, k)
+		} else {
+			config[k] = v
 		}
 	}
-	// loading busybox image to this daemon
-	if out, err := d.Cmd("load", "--input", bb); err != nil {
-		return fmt.Errorf("could not load busybox image: %s", out)
+	if b, err = json.Marshal(config); err != nil {
+		return err
 	}
-	if err := os.Remove(bb); err != nil {
-		d.c.Logf("could not remove %s: %v", bb, err)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
 	}
-	return nil
-}
 
-func (d *Daemon) queryRootDir() (string, error) {
-	// update daemon root by asking /info endpoint (to support user
-	// namespaced daemon with root remapped uid.gid directory)
-	clientConfig, err := d.getClientConfig()
+	info, err := d.Info()
 	if err != nil {
-		return "", err
-	}
-
-	client := &http.Client{
-		Transport: clientConfig.transport,
+		return err
 	}
-
-	req, err := http.NewRequest("GET", "/info", nil)
+	since, err := d.ServerTime()
 	if err != nil {
-		return "", err
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.URL.Host = clientConfig.addr
-	req.URL.Scheme = clientConfig.scheme
-
-	resp, err := client.Do(req)
+	fi, err := os.Stat(d.logPath())
 	if err != nil {
-		return "", err
+		return err
 	}
-	body := ioutils.NewReadCloserWrapper(resp.Body, func() error {
-		return resp.Body.Close()
-	})
-
-	type Info struct {
-		DockerRootDir string
+	if err := d.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("[%s] could not signal daemon to reload: %v", d.id, err)
 	}
-	var b []byte
-	var i Info
-	b, err = readBody(body)
-	if err == nil && resp.StatusCode == 200 {
-		// read the docker root dir
-		if err = json.Unmarshal(b, &i); err == nil {
-			return i.DockerRootDir, nil
-		}
+	if err := d.waitForReload(since, fi.Size()); err != nil {
+		return err
 	}
-	return "", err
+	// disabling debug resets the daemon to the info level, whatever
+	// log-level it was started with
+	if debug, ok := config["debug"].(bool); ok && !debug && info.Debug {
+		d.debugReset = true
+	}
+	return nil
 }
 
-func (d *Daemon) sock() string {
-	return fmt.Sprintf("unix://%s/docker.sock", d.folder)
-}
+// waitForReload waits for a reload event after since, and fails if the
+// daemon logs an error after offset in its log file before that.
+func (d *Daemon) waitForReload(since time.Time, offset int64) error {
+	after := time.After(reloadTimeout)
+	for {
+		if line, err := d.logErrorAfter(offset); err != nil || line != "" {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("[%s] daemon rejected the configuration: %s", d.id, line)
+		}
 
-func (d *Daemon) waitRun(contID string) error {
-	args := []string{"--host", d.sock()}
-	return waitInspectWithArgs(contID, "{{.State.Running}}", "true", 10*time.Second, args...)
-}
+		until, err := d.ServerTime()
+		if err != nil {
+			return err
+		}
+		out, err := d.Cmd("events", "--since", parseEventTime(since), "--until", parseEventTime(until), "--filter", "type=daemon", "--filter", "event=reload")
+		if err != nil {
+			return fmt.Errorf("[%s] could not get events: %v\n%s", d.id, err, out)
+		}
+		if strings.TrimSpace(out) != "" {
+			return nil
+		}
+
+		select {
+		case <-after:
+			return fmt.Errorf("[%s] daemon did not reload within %v%s", d.id, reloadTimeout, d.logTail())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// logErrorAfter returns the first error level line in the daemon log after
+// offset, if any.
+func (d *Daemon) logErrorAfter(offset int64) (string, error) {
+	f, err := os.Open(d.logPath())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "level=error") {
+			return scanner.Text(), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// configFile returns the --config-file the running daemon was started with.
+func (d *Daemon) configFile() string {
+	return d.flagValue("--config-file")
+}
+
+// flagValue returns the value of the last of the named flags the running
+// daemon was started with, or "" if none was given.
+func (d *Daemon) flagValue(names ...string) string {
+	var value string
+	args := d.cmd.Args
+	for i, a := range args {
+		for _, name := range names {
+			if strings.HasPrefix(a, name+"=") {
+				value = strings.TrimPrefix(a, name+"=")
+			} else if a == name && i+1 < len(args) {
+				value = args[i+1]
+			}
+		}
+	}
+	return value
+}
+
+// EffectiveProxyConfig returns the proxy configuration the daemon reports
+// in /info.
+func (d *Daemon) EffectiveProxyConfig() (ProxyConfig, error) {
+	info, err := d.Info()
+	if err != nil {
+		return ProxyConfig{}, err
+	}
+	return ProxyConfig{
+		HTTP:    info.HTTPProxy,
+		HTTPS:   info.HTTPSProxy,
+		NoProxy: info.NoProxy,
+	}, nil
+}
+
+// EffectiveLogLevel returns the level the daemon currently logs at. That is
+// "debug" while debug is enabled, "info" once UpdateConfig disabled debug,
+// and otherwise the log-level it was started with, "info" by default.
+func (d *Daemon) EffectiveLogLevel() (string, error) {
+	if d.cmd == nil {
+		return "", errors.New("daemon not started")
+	}
+	info, err := d.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.Debug {
+		return "debug", nil
+	}
+	if d.debugReset {
+		return "info", nil
+	}
+	if level := d.flagValue("-l", "--log-level"); level != "" {
+		return level, nil
+	}
+	if path := d.configFile(); path != "" {
+		var config struct {
+			LogLevel string `json:"log-level"`
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return "", err
+		}
+		if config.LogLevel != "" {
+			return config.LogLevel, nil
+		}
+	}
+	return "info", nil
+}
+
+// StartDaemons starts the given daemons concurrently with the same flags
+// and returns once all of them are ready. Every daemon that failed to start
+// is reported in the returned error.
+func StartDaemons(daemons []*Daemon, args ...string) error {
+	errs := make([]error, len(daemons))
+	sem := make(chan struct{}, maxParallelDaemonStarts)
+	var wg sync.WaitGroup
+	for i, d := range daemons {
+		wg.Add(1)
+		go func(i int, d *Daemon) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = d.Start(args...)
+		}(i, d)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not start daemons: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// StopDaemons stops all the given daemons, even if stopping some of them
+// fails, and returns the errors of those that failed.
+func StopDaemons(daemons ...*Daemon) []error {
+	var errs []error
+	for _, d := range daemons {
+		if err := d.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("[%s] %v", d.id, err))
+		}
+	}
+	return errs
+}
+
+// MustStopDaemons stops all the given daemons and fails the test if any of
+// them did not stop cleanly.
+func MustStopDaemons(c *check.C, daemons ...*Daemon) {
+	errs := StopDaemons(daemons...)
+	c.Assert(errs, checker.HasLen, 0, check.Commentf("%v", errs))
+}
+
+// StartWithBusybox will first start the daemon with Daemon.Start()
+// then save the busybox image from the main daemon and load it into this Daemon instance.
+func (d *Daemon) StartWithBusybox(arg ...string) error {
+	return d.StartWithImages([]string{"busybox:latest"}, arg...)
+}
+
+// StartWithImages will first start the daemon with Daemon.Start()
+// then save the given images from the main daemon and load them into this Daemon instance.
+func (d *Daemon) StartWithImages(images []string, arg ...string) error {
+	if err := d.Start(arg...); err != nil {
+		return err
+	}
+	return d.LoadImages(images...)
+}
+
+// Kill will send a SIGKILL to the daemon
+func (d *Daemon) Kill() error {
+	if d.cmd == nil || d.wait == nil {
+		return errors.New("daemon not started")
+	}
+
+	defer func() {
+		if !d.keepLogFile {
+			d.logFile.Close()
+		}
+		d.cmd = nil
+		d.stopWatchingForPanics()
+		d.stopResourceSampler()
+	}()
+
+	if err := d.runCleanups(); err != nil {
+		d.c.Logf("[%s] %v", d.id, err)
+	}
+
+	if err := d.cmd.Process.Kill(); err != nil {
+		d.c.Logf("Could not kill daemon: %v", err)
+		return err
+	}
+	<-d.wait
+	d.exitState = d.cmd.ProcessState
+	d.killed = true
+
+	if err := d.removePidfile(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stop will send a SIGINT to the daemon and wait for it to stop.
+// If it does not stop within StopTimeout, a SIGKILL is sent.
+// Stop will not delete the daemon directory. If a purged daemon is needed,
+// instantiate a new one with NewDaemon.
+func (d *Daemon) Stop() error {
+	if d.cmd == nil || d.wait == nil {
+		return errors.New("daemon not started")
+	}
+
+	defer func() {
+		if !d.keepLogFile {
+			d.logFile.Close()
+		}
+		d.cmd = nil
+		d.stopWatchingForPanics()
+		d.stopResourceSampler()
+	}()
+
+	cleanupErr := d.runCleanups()
+
+	timeout := d.StopTimeout
+	if timeout == 0 {
+		timeout = defaultStopTimeout
+	}
+
+	d.c.Logf("[%s] interrupting daemon with pid %d", d.id, d.cmd.Process.Pid)
+	if err := d.cmd.Process.Signal(os.Interrupt); err != nil {
+		return fmt.Errorf("could not send signal: %v", err)
+	}
+
+	select {
+	case err := <-d.wait:
+		d.exitState = d.cmd.ProcessState
+		if err != nil {
+			return err
+		}
+		return cleanupErr
+	case <-time.After(timeout):
+	}
+
+	d.c.Logf("[%s] daemon did not stop within %v, now try to kill it%s", d.id, timeout, d.logTail())
+	if err := d.cmd.Process.Kill(); err != nil {
+		d.c.Logf("Could not kill daemon: %v", err)
+		return err
+	}
+	waitErr := <-d.wait
+	d.exitState = d.cmd.ProcessState
+	d.killed = true
+
+	if err := d.removePidfile(); err != nil {
+		return err
+	}
+
+	return waitErr
+}
+
+// removePidfile removes the pidfile of a daemon that did not get to clean
+// up after itself. A missing pidfile is not an error.
+func (d *Daemon) removePidfile() error {
+	if err := os.Remove(fmt.Sprintf("%s/docker.pid", d.folder)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// HasPanicked returns whether the daemon has logged a panic or a fatal
+// error since it was last started, and the logged text.
+func (d *Daemon) HasPanicked() (bool, string) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.panicMsg != "", d.panicMsg
+}
+
+// watchForPanics follows the log file at path from its current end, and
+// records the first panic the daemon writes to it, until stop is closed.
+func (d *Daemon) watchForPanics(path string, stop <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_END); err != nil {
+		f.Close()
+		return err
+	}
+
+	go func() {
+		defer f.Close()
+		r := bufio.NewReader(f)
+		var partial string
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				// wait for the rest of the line
+				partial += line
+				select {
+				case <-stop:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+				continue
+			}
+			line, partial = partial+line, ""
+
+			if lines == nil && !containsAny(line, panicMarkers) {
+				continue
+			}
+			if len(lines) < maxPanicLines {
+				lines = append(lines, strings.TrimRight(line, "\n"))
+				d.mu.Lock()
+				d.panicMsg = strings.Join(lines, "\n")
+				d.mu.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *Daemon) stopWatchingForPanics() {
+	if d.stopPanicWatch != nil {
+		close(d.stopPanicWatch)
+		d.stopPanicWatch = nil
+	}
+}
+
+// ResourceSample is the memory and CPU usage of the daemon process at a
+// point in time.
+type ResourceSample struct {
+	Time time.Time
+	// RSS is the resident set size in bytes.
+	RSS int64
+	// CPUTime is the user and system CPU time consumed so far.
+	CPUTime time.Duration
+}
+
+// Pid returns the process ID of the running daemon, or 0 if it is not
+// running.
+func (d *Daemon) Pid() int {
+	if d.cmd == nil || d.cmd.Process == nil {
+		return 0
+	}
+	return d.cmd.Process.Pid
+}
+
+// StartResourceSampler samples the resource usage of the daemon process
+// every interval until the daemon is stopped or killed. The samples of an
+// earlier run are discarded.
+func (d *Daemon) StartResourceSampler(interval time.Duration) error {
+	pid := d.Pid()
+	if pid == 0 {
+		return errors.New("daemon not started")
+	}
+	d.stopResourceSampler()
+	d.mu.Lock()
+	d.samples = nil
+	d.mu.Unlock()
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.stopSampler, d.samplerDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			sample, err := readResourceSample(pid)
+			if err != nil {
+				d.c.Logf("[%s] stopped sampling resources: %v", d.id, err)
+				return
+			}
+			d.mu.Lock()
+			d.samples = append(d.samples, sample)
+			d.mu.Unlock()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// ResourceSamples returns the samples collected since StartResourceSampler
+// was last called.
+func (d *Daemon) ResourceSamples() []ResourceSample {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]ResourceSample(nil), d.samples...)
+}
+
+func (d *Daemon) stopResourceSampler() {
+	if d.stopSampler != nil {
+		close(d.stopSampler)
+		<-d.samplerDone
+		d.stopSampler, d.samplerDone = nil, nil
+	}
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitExit waits for the daemon process to exit and returns its exit code.
+// If the daemon had to be killed, errDaemonKilled is returned along with it.
+func (d *Daemon) WaitExit() (int, error) {
+	if d.exitState == nil {
+		if d.cmd == nil || d.wait == nil {
+			return -1, errors.New("daemon not started")
+		}
+		<-d.wait
+		d.exitState = d.cmd.ProcessState
+	}
+
+	code := d.exitState.Sys().(syscall.WaitStatus).ExitStatus()
+	if d.killed {
+		return code, errDaemonKilled
+	}
+	return code, nil
+}
+
+// forcedShutdownLog is logged by a daemon whose shutdown hooks did not
+// complete in time.
+const forcedShutdownLog = "Force shutdown daemon"
+
+// CleanExit returns an error unless the daemon exited with status 0 after
+// the last Stop, without having to be killed and with its shutdown hooks
+// completing in time.
+func (d *Daemon) CleanExit() error {
+	if d.exitState == nil {
+		return fmt.Errorf("[%s] daemon has not exited", d.id)
+	}
+	if d.killed {
+		return fmt.Errorf("[%s] daemon did not stop on interrupt and was killed", d.id)
+	}
+	if code := d.exitState.Sys().(syscall.WaitStatus).ExitStatus(); code != 0 {
+		return fmt.Errorf("[%s] daemon exited with status %d%s", d.id, code, d.logTail())
+	}
+	content, err := d.logSinceStart()
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(content, []byte(forcedShutdownLog)) {
+		return fmt.Errorf("[%s] daemon shutdown did not complete in time%s", d.id, d.logTail())
+	}
+	return nil
+}
+
+// logSinceStart returns what the daemon logged since it was last started.
+func (d *Daemon) logSinceStart() ([]byte, error) {
+	content, err := ioutil.ReadFile(d.logPath())
+	if err != nil {
+		return nil, err
+	}
+	// earlier runs of the daemon are logged to the same file
+	if d.logStart <= int64(len(content)) {
+		content = content[d.logStart:]
+	}
+	return content, nil
+}
+
+// AssertCleanExit fails the test unless CleanExit succeeds.
+func (d *Daemon) AssertCleanExit(c *check.C) {
+	c.Assert(d.CleanExit(), check.IsNil)
+}
+
+// AssertNoLeakedMounts returns an error if anything is still mounted under
+// the daemon root once the daemon has stopped. Mountpoints listed in allowed
+// are expected to remain and are ignored.
+func (d *Daemon) AssertNoLeakedMounts(allowed ...string) error {
+	if d.cmd != nil {
+		return fmt.Errorf("[%s] daemon is still running", d.id)
+	}
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return err
+	}
+
+	allowedSet := make(map[string]struct{}, len(allowed))
+	for _, m := range allowed {
+		allowedSet[filepath.Clean(m)] = struct{}{}
+	}
+
+	root := d.rootDir()
+	var leaked []string
+	for _, m := range mounts {
+		if _, ok := allowedSet[m.Mountpoint]; ok {
+			continue
+		}
+		if m.Mountpoint == root || strings.HasPrefix(m.Mountpoint, root+string(filepath.Separator)) {
+			leaked = append(leaked, m.Mountpoint)
+		}
+	}
+	if len(leaked) > 0 {
+		return fmt.Errorf("[%s] leaked mounts under %s: %s", d.id, root, strings.Join(leaked, ", "))
+	}
+	return nil
+}
+
+// Cleanup stops the daemon if it is running and removes its directory,
+// including the root, the log file and the socket.
+func (d *Daemon) Cleanup() error {
+	if d.cmd != nil {
+		if err := d.Stop(); err != nil {
+			d.c.Logf("[%s] error stopping daemon: %v", d.id, err)
+		}
+	} else if err := d.runCleanups(); err != nil {
+		d.c.Logf("[%s] %v", d.id, err)
+	}
+	if d.KeepFolderOnFailure && d.c.Failed() {
+		d.c.Logf("[%s] test failed, keeping %s", d.id, d.folder)
+		return nil
+	}
+	return os.RemoveAll(d.folder)
+}
+
+// AddCleanup registers fn to be run by the next Stop, Kill or Cleanup,
+// while the daemon is still running. Cleanups run in reverse order of
+// registration, and every one of them runs even if others fail.
+func (d *Daemon) AddCleanup(fn func() error) {
+	d.cleanups = append(d.cleanups, fn)
+}
+
+// runCleanups runs and unregisters the functions added with AddCleanup.
+func (d *Daemon) runCleanups() error {
+	var failed []string
+	for i := len(d.cleanups) - 1; i >= 0; i-- {
+		if err := d.cleanups[i](); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	d.cleanups = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("cleanup failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// DaemonPool hands out daemons to a test and makes sure every one of them
+// is stopped and its directory removed by CleanupAll.
+type DaemonPool struct {
+	c    *check.C
+	mu   sync.Mutex
+	all  []*Daemon
+	idle []*Daemon
+}
+
+// NewDaemonPool returns an empty DaemonPool.
+func NewDaemonPool(c *check.C) *DaemonPool {
+	return &DaemonPool{c: c}
+}
+
+// Acquire returns a stopped daemon. A daemon previously given back with
+// Release is reused if there is one; it keeps its root and settings.
+func (p *DaemonPool) Acquire() *Daemon {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.idle); n > 0 {
+		d := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return d
+	}
+	d := NewDaemon(p.c)
+	p.all = append(p.all, d)
+	return d
+}
+
+// Release stops d and makes it available to Acquire again. A daemon that
+// does not stop cleanly is not reused.
+func (p *DaemonPool) Release(d *Daemon) {
+	if d.cmd != nil {
+		if err := d.Stop(); err != nil {
+			p.c.Logf("[%s] not reusing daemon, stop failed: %v", d.id, err)
+			return
+		}
+	}
+	p.mu.Lock()
+	p.idle = append(p.idle, d)
+	p.mu.Unlock()
+}
+
+// CleanupAll stops every daemon acquired from the pool and removes its
+// directory. It keeps going on failure and returns the first error.
+func (p *DaemonPool) CleanupAll() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var firstErr error
+	for _, d := range p.all {
+		if err := d.Cleanup(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.all = nil
+	p.idle = nil
+	return firstErr
+}
+
+// daemonFolderRegexp matches the directories NewDaemon creates in $DEST.
+var daemonFolderRegexp = regexp.MustCompile(`^d[0-9]+$`)
+
+// orphanedDaemonFolderAge is how long a daemon directory has to be left
+// untouched before it is considered to belong to a test binary that did
+// not get to clean up.
+const orphanedDaemonFolderAge = 24 * time.Hour
+
+// removeOrphanedDaemonFolders removes the daemon directories in dest that
+// have not been modified for longer than age.
+func removeOrphanedDaemonFolders(dest string, age time.Duration) error {
+	fis, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || !daemonFolderRegexp.MatchString(fi.Name()) || time.Since(fi.ModTime()) < age {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dest, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restart will restart the daemon by first stopping it and then starting it.
+func (d *Daemon) Restart(arg ...string) error {
+	d.Stop()
+	return d.Start(arg...)
+}
+
+// RestartWithLogFile will restart the daemon by first stopping it and then
+// starting it with its streams attached to out.
+func (d *Daemon) RestartWithLogFile(out *os.File, arg ...string) error {
+	if d.logFile == out {
+		// Stop closes the log file, keep the caller's one open
+		d.keepLogFile = true
+		defer func() { d.keepLogFile = false }()
+	}
+	if err := d.Stop(); err != nil {
+		d.c.Logf("[%s] error stopping daemon: %v", d.id, err)
+	}
+	return d.StartWithLogFile(out, arg...)
+}
+
+// LoadBusybox will load the stored busybox into a newly started daemon
+func (d *Daemon) LoadBusybox() error {
+	return d.LoadImages("busybox:latest")
+}
+
+// LoadImages will save the given images from the main daemon and load them
+// into this daemon. The images are loaded concurrently and every image that
+// could not be loaded is reported in the returned error.
+func (d *Daemon) LoadImages(images ...string) error {
+	errs := make([]error, len(images))
+	var wg sync.WaitGroup
+	for i, image := range images {
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			errs[i] = d.loadImage(image)
+		}(i, image)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", images[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("[%s] could not load images: %s", d.id, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (d *Daemon) loadImage(image string) error {
+	tar := filepath.Join(d.folder, strings.NewReplacer("/", "_", ":", "_").Replace(image)+".tar")
+	if _, err := os.Stat(tar); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("unexpected error on %s stat: %v", filepath.Base(tar), err)
+		}
+		// saving image from main daemon
+		if out, err := exec.Command(dockerBinary, "save", "--output", tar, image).CombinedOutput(); err != nil {
+			return fmt.Errorf("could not save image: %s", out)
+		}
+	}
+	// loading image to this daemon
+	if err := d.LoadImageFromFile(tar); err != nil {
+		return err
+	}
+	if err := os.Remove(tar); err != nil {
+		d.c.Logf("could not remove %s: %v", tar, err)
+	}
+	return nil
+}
+
+// SaveImage saves ref from this daemon to a tar archive at destPath.
+func (d *Daemon) SaveImage(ref, destPath string) error {
+	if out, err := d.Cmd("save", "--output", destPath, ref); err != nil {
+		return fmt.Errorf("[%s] could not save image %s: %s", d.id, ref, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// LoadImageFromFile loads the images of the tar archive at path into this
+// daemon.
+func (d *Daemon) LoadImageFromFile(path string) error {
+	if out, err := d.Cmd("load", "--input", path); err != nil {
+		return fmt.Errorf("[%s] could not load image from %s: %s", d.id, path, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// remappedRootRegexp matches the "uid.gid" directory a user namespace
+// remapped daemon keeps its data in.
+var remappedRootRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// baseRoot returns the root directory to start the daemon with.
+// A daemon running with user namespace remapping (UsernsRemap) keeps its
+// data in a "uid.gid" subdirectory of the root it was given, and that
+// subdirectory is what queryRootDir stores in d.root once the daemon is up.
+// The suffix is stripped again so that starting the daemon once more reuses
+// the same root instead of nesting another "uid.gid" directory in it. This
+// is done even if UsernsRemap was cleared in between, as the root NewDaemon
+// picks never looks like "uid.gid".
+func (d *Daemon) baseRoot() string {
+	root := d.rootDir()
+	if remappedRootRegexp.MatchString(filepath.Base(root)) {
+		return filepath.Dir(root)
+	}
+	return root
+}
+
+// rootDir returns the root directory of the daemon, which queryRootDir
+// updates once the daemon is up.
+func (d *Daemon) rootDir() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.root
+}
+
+func (d *Daemon) queryRootDir() (string, error) {
+	// update daemon root by asking /info endpoint (to support user
+	// namespaced daemon with root remapped uid.gid directory)
+	info, err := d.Info()
+	if err != nil {
+		return "", err
+	}
+	return info.DockerRootDir, nil
+}
+
+// SockRequest executes a socket request on the daemon and returns the status
+// code and the output.
+func (d *Daemon) SockRequest(method, endpoint string, data interface{}) (int, []byte, error) {
+	jsonData := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(jsonData).Encode(data); err != nil {
+		return -1, nil, err
+	}
+
+	res, body, err := d.SockRequestRaw(method, endpoint, jsonData, "application/json")
+	if err != nil {
+		return -1, nil, err
+	}
+	b, err := readBody(body)
+	return res.StatusCode, b, err
+}
+
+// SockRequestRaw executes a socket request on the daemon and returns the
+// response and a reader for the output data.
+func (d *Daemon) SockRequestRaw(method, endpoint string, data io.Reader, ct string) (*http.Response, io.ReadCloser, error) {
+	clientConfig, err := d.getClientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &http.Client{
+		Transport: clientConfig.transport,
+	}
+
+	req, err := http.NewRequest(method, endpoint, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create new request: %v", err)
+	}
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	req.URL.Host = clientConfig.addr
+	req.URL.Scheme = clientConfig.scheme
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Every request gets a new transport, so once the body is closed its
+	// connection would never be reused and only stay open until the daemon
+	// goes away.
+	body := resp.Body
+	resp.Body = ioutils.NewReadCloserWrapper(body, func() error {
+		defer clientConfig.transport.CloseIdleConnections()
+		return body.Close()
+	})
+	return resp, resp.Body, nil
+}
+
+// APICall sends a request to the daemon API and returns the raw response.
+// The caller has to close the response body.
+func (d *Daemon) APICall(method, path string, body io.Reader) (*http.Response, error) {
+	if err := d.checkAPIVersion(); err != nil {
+		return nil, err
+	}
+	if d.APIVersion != "" {
+		path = "/v" + d.APIVersion + path
+	}
+	ct := ""
+	if body != nil {
+		ct = "application/json"
+	}
+	resp, _, err := d.SockRequestRaw(method, path, body, ct)
+	return resp, err
+}
+
+func (d *Daemon) checkAPIVersion() error {
+	if d.APIVersion != "" && !apiVersionRegexp.MatchString(d.APIVersion) {
+		return fmt.Errorf("[%s] invalid API version %q", d.id, d.APIVersion)
+	}
+	return nil
+}
+
+// APICallJSON sends in as JSON to the daemon API, if not nil, and decodes
+// the response into out, if not nil. Statuses of 400 and above are
+// returned as errors.
+func (d *Daemon) APICallJSON(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := d.APICall(method, path, body)
+	if err != nil {
+		return err
+	}
+	b, err := readBody(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("[%s] %s %s: unexpected status %d: %s", d.id, method, path, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// Version returns the version information reported by the daemon. The result
+// is cached until the daemon is started again.
+func (d *Daemon) Version() (types.Version, error) {
+	if d.version != nil {
+		return *d.version, nil
+	}
+
+	status, body, err := d.SockRequest("GET", "/version", nil)
+	if err != nil {
+		return types.Version{}, err
+	}
+	if status != http.StatusOK {
+		return types.Version{}, fmt.Errorf("[%s] unexpected status %d querying version: %s", d.id, status, body)
+	}
+
+	var v types.Version
+	if err := json.Unmarshal(body, &v); err != nil {
+		return types.Version{}, err
+	}
+	d.version = &v
+	return v, nil
+}
+
+// Info returns the system information reported by the daemon.
+func (d *Daemon) Info() (types.Info, error) {
+	var info types.Info
+	status, body, err := d.SockRequest("GET", "/info", nil)
+	if err != nil {
+		return info, err
+	}
+	if status != http.StatusOK {
+		return info, fmt.Errorf("[%s] unexpected status %d querying info: %s", d.id, status, body)
+	}
+	err = json.Unmarshal(body, &info)
+	return info, err
+}
+
+// ServerTime returns the current time on the daemon host, as reported by
+// /info, so that time windows can be computed independently of clock skew
+// between the test and the daemon.
+func (d *Daemon) ServerTime() (time.Time, error) {
+	info, err := d.Info()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, info.SystemTime)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("[%s] invalid time format in GET /info response: %v", d.id, err)
+	}
+	return t, nil
+}
+
+// daemonFeatures are the kernel and cgroup capabilities reported by /info
+// that RequireFeature can check, with the warning docker info prints when
+// they are missing.
+var daemonFeatures = []struct {
+	name      string
+	warning   string
+	supported func(types.Info) bool
+}{
+	{"memory-limit", "No memory limit support", func(i types.Info) bool { return i.MemoryLimit }},
+	{"swap-limit", "No swap limit support", func(i types.Info) bool { return i.SwapLimit }},
+	{"kernel-memory", "No kernel memory limit support", func(i types.Info) bool { return i.KernelMemory }},
+	{"oom-kill-disable", "No oom kill disable support", func(i types.Info) bool { return i.OomKillDisable }},
+	{"cpu-cfs-quota", "No cpu cfs quota support", func(i types.Info) bool { return i.CPUCfsQuota }},
+	{"cpu-cfs-period", "No cpu cfs period support", func(i types.Info) bool { return i.CPUCfsPeriod }},
+	{"cpu-shares", "No cpu shares support", func(i types.Info) bool { return i.CPUShares }},
+	{"cpuset", "No cpuset support", func(i types.Info) bool { return i.CPUSet }},
+	{"ipv4-forwarding", "IPv4 forwarding is disabled", func(i types.Info) bool { return i.IPv4Forwarding }},
+	{"bridge-nf-iptables", "bridge-nf-call-iptables is disabled", func(i types.Info) bool { return i.BridgeNfIptables }},
+	{"bridge-nf-ip6tables", "bridge-nf-call-ip6tables is disabled", func(i types.Info) bool { return i.BridgeNfIP6tables }},
+}
+
+// Warnings returns the warnings docker info prints for the capabilities
+// the daemon reports as missing.
+func (d *Daemon) Warnings() ([]string, error) {
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	if info.OSType == "windows" {
+		return warnings, nil
+	}
+	for _, f := range daemonFeatures {
+		if !f.supported(info) {
+			warnings = append(warnings, f.warning)
+		}
+	}
+	return warnings, nil
+}
+
+// RequireFeature skips the test unless the daemon reports the named
+// capability, e.g. "swap-limit", as supported. See daemonFeatures for the
+// known names.
+func (d *Daemon) RequireFeature(feature string) {
+	info, err := d.Info()
+	d.c.Assert(err, check.IsNil)
+	for _, f := range daemonFeatures {
+		if f.name == feature {
+			if !f.supported(info) {
+				d.c.Skip(fmt.Sprintf("daemon %s: %s", d.id, f.warning))
+			}
+			return
+		}
+	}
+	d.c.Fatalf("[%s] unknown daemon feature %q", d.id, feature)
+}
+
+// SupportsExperimental returns whether the running daemon is an
+// experimental build.
+func (d *Daemon) SupportsExperimental() bool {
+	info, err := d.Info()
+	if err != nil {
+		d.c.Logf("[%s] could not query info: %v", d.id, err)
+		return false
+	}
+	return info.ExperimentalBuild
+}
+
+// CheckCgroupDriver returns an error if the running daemon does not use the
+// cgroup driver requested with CgroupDriver.
+func (d *Daemon) CheckCgroupDriver() error {
+	if d.CgroupDriver == "" {
+		return nil
+	}
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	if info.CgroupDriver != d.CgroupDriver {
+		return fmt.Errorf("[%s] daemon uses cgroup driver %q, expected %q", d.id, info.CgroupDriver, d.CgroupDriver)
+	}
+	return nil
+}
+
+func (d *Daemon) sock() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.tcpAddr != "" {
+		return fmt.Sprintf("tcp://%s", d.tcpAddr)
+	}
+	proto, addr := d.defaultSock()
+	return fmt.Sprintf("%s://%s", proto, filepath.ToSlash(addr))
+}
+
+// freeTCPAddr returns a host:port on bindAddr that was free at the time of
+// the call.
+func freeTCPAddr(bindAddr string) (string, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(bindAddr, "0"))
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func (d *Daemon) waitRun(contID string) error {
+	return d.WaitRun(contID, 10*time.Second)
+}
+
+// WaitRun waits for a container to be running for up to timeout. The error
+// on timeout contains the last observed state.
+func (d *Daemon) WaitRun(contID string, timeout time.Duration) error {
+	args := []string{"--host", d.sock()}
+	return waitInspectWithArgs(contID, "{{.State.Running}}", "true", timeout, args...)
+}
+
+// WaitForContainerExit waits up to timeout for a container to stop running
+// and returns its exit code.
+func (d *Daemon) WaitForContainerExit(containerID string, timeout time.Duration) (int, error) {
+	after := time.After(timeout)
+	for {
+		running, err := d.inspectFilter(containerID, ".State.Running")
+		if err != nil {
+			return -1, err
+		}
+		if running == "false" {
+			break
+		}
+		select {
+		case <-after:
+			return -1, fmt.Errorf("[%s] container %s still running after %v", d.id, containerID, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	out, err := d.inspectFilter(containerID, ".State.ExitCode")
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(out)
+}
+
+// RunOOMContainer runs a detached busybox container, limited to memory
+// without any swap, that allocates memory until the OOM killer stops it, and
+// returns the container ID. The test is skipped if the daemon can't limit
+// memory and swap.
+func (d *Daemon) RunOOMContainer(memory string) (string, error) {
+	d.RequireFeature("memory-limit")
+	d.RequireFeature("swap-limit")
+	out, err := d.Cmd("run", "-d", "--memory", memory, "--memory-swap", memory,
+		"busybox", "sh", "-c", "x=a; while true; do x=$x$x$x$x; done")
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not run memory hog: %v\n%s", d.id, err, out)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// WaitForOOM waits until the container was killed by the OOM killer, or
+// fails after timeout.
+func (d *Daemon) WaitForOOM(containerID string, timeout time.Duration) error {
+	after := time.After(timeout)
+	for {
+		out, err := d.inspectFilter(containerID, ".State.OOMKilled")
+		if err != nil {
+			return err
+		}
+		if out == "true" {
+			return nil
+		}
+		select {
+		case <-after:
+			return fmt.Errorf("[%s] container %s not OOM killed after %v", d.id, containerID, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// ContainerExitCode returns the exit code of the container, which is 137
+// after it was OOM killed.
+func (d *Daemon) ContainerExitCode(containerID string) (int, error) {
+	out, err := d.inspectFilter(containerID, ".State.ExitCode")
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(out)
+}
+
+// WaitForContainerLog follows the output of a container until a line matches
+// pattern. If the timeout passes first, or the container exits without
+// printing such a line, the error holds the output so far and, for a
+// container that exited, its exit code.
+func (d *Daemon) WaitForContainerLog(containerID string, pattern *regexp.Regexp, timeout time.Duration) error {
+	if err := d.checkAPIVersion(); err != nil {
+		return err
+	}
+	c := exec.Command(dockerBinary, "--host", d.sock(), "logs", "-f", containerID)
+	c.Env = d.cmdEnv()
+	r, w := io.Pipe()
+	c.Stdout = w
+	c.Stderr = w
+	if err := c.Start(); err != nil {
+		return fmt.Errorf("[%s] could not follow logs of %s: %v", d.id, containerID, err)
+	}
+	// docker logs -f returns once the container stopped, which ends the scan
+	go func() {
+		w.CloseWithError(c.Wait())
+	}()
+
+	var logs bytes.Buffer
+	matched := make(chan bool, 1)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			logs.WriteString(s.Text() + "\n")
+			if pattern.MatchString(s.Text()) {
+				matched <- true
+				return
+			}
+		}
+		matched <- false
+	}()
+
+	var found, timedOut bool
+	select {
+	case found = <-matched:
+	case <-time.After(timeout):
+		timedOut = true
+		c.Process.Kill()
+		found = <-matched
+	}
+	c.Process.Kill()
+	// unblocks the CLI if it's still writing
+	r.Close()
+
+	switch {
+	case found:
+		return nil
+	case timedOut:
+		return fmt.Errorf("[%s] container %s logged no line matching %q within %v:\n%s", d.id, containerID, pattern, timeout, logs.String())
+	}
+	exitCode, err := d.ContainerExitCode(containerID)
+	if err != nil {
+		return fmt.Errorf("[%s] following logs of %s ended before a line matched %q: %v\n%s", d.id, containerID, pattern, err, logs.String())
+	}
+	return fmt.Errorf("[%s] container %s exited with code %d before logging a line matching %q:\n%s", d.id, containerID, exitCode, pattern, logs.String())
+}
+
+// WaitForPort waits until containerPort, e.g. "80" or "53/udp", of the
+// container is published and returns the host port it is published on,
+// which may have been chosen by the daemon. For TCP ports it also waits until
+// the host port accepts connections.
+func (d *Daemon) WaitForPort(containerID, containerPort string, timeout time.Duration) (string, error) {
+	if !strings.Contains(containerPort, "/") {
+		containerPort += "/tcp"
+	}
+	after := time.After(timeout)
+	var hostIP, hostPort string
+	for {
+		if hostPort == "" {
+			out, err := d.inspectFilter(containerID, "json .NetworkSettings.Ports")
+			if err != nil {
+				return "", err
+			}
+			var ports map[string][]struct {
+				HostIP   string
+				HostPort string
+			}
+			if err := json.Unmarshal([]byte(out), &ports); err != nil {
+				return "", err
+			}
+			if bindings := ports[containerPort]; len(bindings) > 0 {
+				hostIP, hostPort = bindings[0].HostIP, bindings[0].HostPort
+			}
+			if hostIP == "" || hostIP == "0.0.0.0" {
+				hostIP = "127.0.0.1"
+			}
+		}
+		if hostPort != "" {
+			if !strings.HasSuffix(containerPort, "/tcp") {
+				return hostPort, nil
+			}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(hostIP, hostPort), time.Second)
+			if err == nil {
+				conn.Close()
+				return hostPort, nil
+			}
+		}
+		select {
+		case <-after:
+			if hostPort == "" {
+				return "", fmt.Errorf("[%s] port %s of container %s not published after %v", d.id, containerPort, containerID, timeout)
+			}
+			return "", fmt.Errorf("[%s] port %s of container %s not accepting connections on %s after %v", d.id, containerPort, containerID, hostPort, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// ContainerExists returns whether the daemon knows a container by the given
+// name or ID. Only a container that doesn't exist is (false, nil); failing
+// to ask the daemon is an error.
+func (d *Daemon) ContainerExists(containerID string) (bool, error) {
+	status, body, err := d.SockRequest("GET", "/containers/"+containerID+"/json", nil)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("[%s] unexpected status %d inspecting %s: %s", d.id, status, containerID, body)
+}
+
+// AssertContainerGone fails the test unless the container doesn't exist.
+func (d *Daemon) AssertContainerGone(c *check.C, containerID string) {
+	exists, err := d.ContainerExists(containerID)
+	c.Assert(err, check.IsNil)
+	c.Assert(exists, check.Equals, false, check.Commentf("container %s still exists", containerID))
+}
+
+// WaitForRemoval waits until the container is gone, e.g. after an
+// asynchronous --rm auto-removal, or fails after timeout.
+func (d *Daemon) WaitForRemoval(containerID string, timeout time.Duration) error {
+	after := time.After(timeout)
+	for {
+		exists, err := d.ContainerExists(containerID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		select {
+		case <-after:
+			return fmt.Errorf("[%s] container %s still exists after %v", d.id, containerID, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// DriverStatus returns the storage driver status reported by /info as
+// key/value pairs. Which keys are present depends on the storage driver.
+func (d *Daemon) DriverStatus() ([][2]string, error) {
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+	return info.DriverStatus, nil
+}
+
+// driverStatusValue returns the value of the storage driver status key.
+func (d *Daemon) driverStatusValue(key string) (string, error) {
+	status, err := d.DriverStatus()
+	if err != nil {
+		return "", err
+	}
+	for _, kv := range status {
+		if kv[0] == key {
+			return kv[1], nil
+		}
+	}
+	return "", fmt.Errorf("[%s] storage driver status has no %q", d.id, key)
+}
+
+func (d *Daemon) getBaseDeviceSize(c *check.C) int64 {
+	basesize, err := d.driverStatusValue("Base Device Size")
+	c.Assert(err, checker.IsNil)
+	// the size is reported in human readable form, e.g. "10.74 GB"
+	basesizeFloat, err := strconv.ParseFloat(strings.Fields(basesize)[0], 64)
+	c.Assert(err, checker.IsNil)
+	basesizeBytes := int64(basesizeFloat) * (1024 * 1024 * 1024)
+	return basesizeBytes
+}
+
+// Cmd will execute a docker CLI command against this Daemon.
+// Example: d.Cmd("version") will run docker -H unix://path/to/unix.sock version
+func (d *Daemon) Cmd(name string, arg ...string) (string, error) {
+	return d.CmdWithStdin(nil, name, arg...)
+}
+
+// CmdWithStdin will execute a docker CLI command against this Daemon with
+// stdin attached to the command's standard input.
+// Example: d.CmdWithStdin(strings.NewReader(dockerfile), "build", "-")
+func (d *Daemon) CmdWithStdin(stdin io.Reader, name string, arg ...string) (string, error) {
+	if err := d.checkAPIVersion(); err != nil {
+		return "", err
+	}
+	args := []string{"--host", d.sock(), name}
+	args = append(args, arg...)
+	c := exec.Command(dockerBinary, args...)
+	c.Stdin = stdin
+	c.Env = d.cmdEnv()
+	b, err := c.CombinedOutput()
+	if err != nil {
+		if panicked, msg := d.HasPanicked(); panicked {
+			err = fmt.Errorf("%v: daemon panicked:\n%s", err, msg)
+		}
+	}
+	return string(b), err
+}
+
+// cmdEnv returns the environment of the CLI commands run by Cmd.
+func (d *Daemon) cmdEnv() []string {
+	env := append(os.Environ(), "DOCKER_CONFIG="+d.ConfigDir)
+	if d.APIVersion != "" {
+		env = append(env, "DOCKER_API_VERSION="+d.APIVersion)
+	}
+	return env
+}
+
+// WriteCLIConfig replaces the config.json in ConfigDir with cfg, e.g.
+// {"psFormat": "{{.Names}}"}.
+func (d *Daemon) WriteCLIConfig(cfg map[string]interface{}) error {
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.ConfigDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.ConfigDir, "config.json"), b, 0600)
+}
+
+// Login logs in to the registry server with the given credentials. The
+// credentials are only used by the commands run through this daemon.
+func (d *Daemon) Login(server, username, password string) error {
+	if out, err := d.Cmd("login", "-u", username, "-p", password, server); err != nil {
+		return fmt.Errorf("[%s] could not log in to %s: %s", d.id, server, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// Logout removes the credentials for the registry server stored by Login.
+func (d *Daemon) Logout(server string) error {
+	if out, err := d.Cmd("logout", server); err != nil {
+		return fmt.Errorf("[%s] could not log out of %s: %s", d.id, server, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// permanentCmdErrors are CLI error messages that retrying cannot fix.
+var permanentCmdErrors = []string{
+	"No such container",
+	"No such image",
+	"No such network",
+	"No such volume",
+}
+
+// CmdRetry will execute a docker CLI command against this Daemon, retrying
+// up to attempts times while it fails. The wait between attempts starts at
+// backoff and doubles after each attempt. Failures that cannot be fixed by
+// retrying, such as a missing object, are returned right away. attempts has
+// to be at least 1.
+func (d *Daemon) CmdRetry(attempts int, backoff time.Duration, name string, arg ...string) (string, error) {
+	if attempts < 1 {
+		return "", fmt.Errorf("[%s] invalid number of attempts %d for %q, must be at least 1", d.id, attempts, name)
+	}
+	var (
+		out string
+		err error
+	)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			d.c.Logf("[%s] attempt #%d of %q failed: %v, retrying in %v", d.id, i, name, err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		out, err = d.Cmd(name, arg...)
+		if err == nil || isPermanentCmdError(out) {
+			break
+		}
+	}
+	return out, err
+}
+
+func isPermanentCmdError(out string) bool {
+	for _, msg := range permanentCmdErrors {
+		if strings.Contains(out, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// CmdWithArgs will execute a docker CLI command against a daemon with the
+// given additional arguments
+func (d *Daemon) CmdWithArgs(daemonArgs []string, name string, arg ...string) (string, error) {
+	args := append(daemonArgs, name)
+	args = append(args, arg...)
+	c := exec.Command(dockerBinary, args...)
+	b, err := c.CombinedOutput()
+	return string(b), err
+}
+
+// AssertNoLeakedContainers returns an error if the daemon has any container,
+// running or not, other than the expected ones. Expected containers are
+// matched by ID, ID prefix or name.
+func (d *Daemon) AssertNoLeakedContainers(expected ...string) error {
+	containers, err := d.listAllContainers()
+	if err != nil {
+		return err
+	}
+
+	var leaked []string
+	for _, ctr := range containers {
+		if !containerMatchesAny(ctr, expected) {
+			leaked = append(leaked, ctr.ID)
+		}
+	}
+	if len(leaked) > 0 {
+		return fmt.Errorf("[%s] leaked containers: %s", d.id, strings.Join(leaked, ", "))
+	}
+	return nil
+}
+
+// RemoveAllContainers removes every container of the daemon. Running
+// containers are only removed if force is set. Their volumes are kept.
+func (d *Daemon) RemoveAllContainers(force bool) error {
+	containers, err := d.listAllContainers()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, ctr := range containers {
+		status, body, err := d.SockRequest("DELETE", fmt.Sprintf("/containers/%s?force=%t", ctr.ID, force), nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if status != http.StatusNoContent {
+			errs = append(errs, fmt.Sprintf("%s: %s", ctr.ID, strings.TrimSpace(string(body))))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("[%s] could not remove all containers: %s", d.id, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (d *Daemon) listAllContainers() ([]types.Container, error) {
+	return d.ListContainers(types.ContainerListOptions{All: true})
+}
+
+// ListContainers lists the containers matching opts, like docker ps. Only
+// running containers are listed unless opts.All is set.
+func (d *Daemon) ListContainers(opts types.ContainerListOptions) ([]types.Container, error) {
+	query := url.Values{}
+	if opts.All {
+		query.Set("all", "1")
+	}
+	if opts.Latest {
+		opts.Limit = 1
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Since != "" {
+		query.Set("since", opts.Since)
+	}
+	if opts.Before != "" {
+		query.Set("before", opts.Before)
+	}
+	if opts.Size {
+		query.Set("size", "1")
+	}
+	if opts.Filter.Len() > 0 {
+		filterJSON, err := filters.ToParam(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", filterJSON)
+	}
+
+	status, body, err := d.SockRequest("GET", "/containers/json?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("[%s] unexpected status %d listing containers: %s", d.id, status, body)
+	}
+
+	var containers []types.Container
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func containerMatchesAny(ctr types.Container, refs []string) bool {
+	for _, ref := range refs {
+		if ref != "" && strings.HasPrefix(ctr.ID, ref) {
+			return true
+		}
+		for _, name := range ctr.Names {
+			if strings.TrimPrefix(name, "/") == strings.TrimPrefix(ref, "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RunContainer runs the default command of image in a detached container
+// and returns the container ID. opts are passed to docker run before the
+// image, like for runSleepingContainerInImage.
+func (d *Daemon) RunContainer(image string, opts ...string) (string, error) {
+	args := append([]string{"-d"}, opts...)
+	args = append(args, image)
+	out, err := d.Cmd("run", args...)
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not run %s: %v\n%s", d.id, image, err, out)
+	}
+	id := strings.TrimSpace(out)
+	if id == "" {
+		return "", fmt.Errorf("[%s] docker run printed no container ID for %s", d.id, image)
+	}
+	return id, nil
+}
+
+// CreateContainer creates a container for the default command of image
+// without starting it, and returns the container ID. opts are passed to
+// docker create before the image.
+func (d *Daemon) CreateContainer(image string, opts ...string) (string, error) {
+	args := append(append([]string{}, opts...), image)
+	out, err := d.Cmd("create", args...)
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not create container for %s: %s", d.id, image, strings.TrimSpace(out))
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// RunContainerAndWait runs the default command of image in the foreground
+// and returns its output and exit code. A non-zero exit code of the
+// container is not an error. opts are passed to docker run before the image.
+func (d *Daemon) RunContainerAndWait(image string, opts ...string) (string, int, error) {
+	args := append(append([]string{}, opts...), image)
+	out, err := d.Cmd("run", args...)
+	if err == nil {
+		return out, 0, nil
+	}
+	exitCode, codeErr := getExitCode(err)
+	// docker run exits with 125 when the container could not be run at all
+	if codeErr != nil || exitCode == 125 {
+		return out, -1, fmt.Errorf("[%s] could not run %s: %v\n%s", d.id, image, err, out)
+	}
+	return out, exitCode, nil
+}
+
+// CommitContainer commits a container to a new image tagged ref, if not
+// empty, and returns the ID of the image. opts, e.g. --change or --message,
+// are passed to docker commit.
+func (d *Daemon) CommitContainer(containerID, ref string, opts ...string) (string, error) {
+	args := append(append([]string{}, opts...), containerID)
+	if ref != "" {
+		args = append(args, ref)
+	}
+	out, err := d.Cmd("commit", args...)
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not commit %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// TagImage adds the tag target to the image source.
+func (d *Daemon) TagImage(source, target string) error {
+	if out, err := d.Cmd("tag", source, target); err != nil {
+		return fmt.Errorf("[%s] could not tag %s as %s: %s", d.id, source, target, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// RemoveImage runs docker rmi on ref and returns its output, which lists
+// the untagged references and deleted layers. On failure the error holds
+// the message of the daemon.
+func (d *Daemon) RemoveImage(ref string, force bool) (string, error) {
+	args := []string{ref}
+	if force {
+		args = []string{"--force", ref}
+	}
+	out, err := d.Cmd("rmi", args...)
+	if err != nil {
+		return out, fmt.Errorf("[%s] could not remove image %s: %s", d.id, ref, strings.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// ExportContainer writes the filesystem of a container as a tar archive to
+// destPath.
+func (d *Daemon) ExportContainer(containerID, destPath string) error {
+	if out, err := d.Cmd("export", "--output", destPath, containerID); err != nil {
+		return fmt.Errorf("[%s] could not export %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// ImportImage creates an image tagged ref from the filesystem tar archive
+// at srcPath and returns its ID. The image has no configuration, like the
+// command to run, as export does not preserve it.
+func (d *Daemon) ImportImage(srcPath, ref string) (string, error) {
+	out, err := d.Cmd("import", srcPath, ref)
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not import %s: %s", d.id, srcPath, strings.TrimSpace(out))
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// ImportFromURL creates an image tagged ref from the filesystem tar archive
+// the daemon downloads from srcURL, and returns its ID.
+func (d *Daemon) ImportFromURL(srcURL, ref string) (string, error) {
+	if !urlutil.IsURL(srcURL) {
+		return "", fmt.Errorf("[%s] %q is not an http or https URL", d.id, srcURL)
+	}
+	return d.ImportImage(srcURL, ref)
+}
+
+// PullImage pulls ref into the daemon and returns the ID of the image.
+func (d *Daemon) PullImage(ref string) (string, error) {
+	if out, err := d.Cmd("pull", ref); err != nil {
+		return "", newRegistryError(out)
+	}
+	return d.inspectFilter(ref, ".Id")
+}
+
+// PullImageWithProgress starts pulling ref, with the latest tag unless it
+// has a tag or digest, and streams the progress messages of the daemon. A
+// message with Error set reports that the pull failed, and is the last one.
+// The channel is closed once the pull is over or ctx is cancelled.
+func (d *Daemon) PullImageWithProgress(ctx context.Context, ref string) (<-chan jsonmessage.JSONMessage, error) {
+	named, err := reference.ParseNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"fromImage": {reference.WithDefaultTag(named).String()}}
+	resp, err := d.APICall("POST", "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := readBody(resp.Body)
+		return nil, fmt.Errorf("[%s] could not pull %s: unexpected status %d: %s", d.id, ref, resp.StatusCode, bytes.TrimSpace(b))
+	}
+
+	messages := make(chan jsonmessage.JSONMessage)
+	done := make(chan struct{})
+	go func() {
+		// unblocks the decoder when ctx is cancelled
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		resp.Body.Close()
+	}()
+	go func() {
+		defer close(messages)
+		defer close(done)
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var m jsonmessage.JSONMessage
+			if err := dec.Decode(&m); err != nil {
+				if err == io.EOF || ctx.Err() != nil {
+					return
+				}
+				m = jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: err.Error()}}
+			}
+			select {
+			case messages <- m:
+			case <-ctx.Done():
+				return
+			}
+			if m.Error != nil {
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// PushImage pushes ref from the daemon to its registry.
+func (d *Daemon) PushImage(ref string) error {
+	if out, err := d.Cmd("push", ref); err != nil {
+		return newRegistryError(out)
+	}
+	return nil
+}
+
+// ImageDigest returns the first repository digest of the image ref, e.g.
+// "127.0.0.1:5000/busybox@sha256:...". The daemon only records the digests
+// of images it pulled, so locally built or pushed images have none.
+func (d *Daemon) ImageDigest(ref string) (string, error) {
+	out, err := d.Cmd("inspect", "--type", "image", "-f", "{{json .RepoDigests}}", ref)
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to inspect %s: %s", d.id, ref, strings.TrimSpace(out))
+	}
+	var digests []string
+	if err := json.Unmarshal([]byte(out), &digests); err != nil {
+		return "", err
+	}
+	if len(digests) == 0 {
+		return "", fmt.Errorf("[%s] image %s has no repository digest, it was not pulled", d.id, ref)
+	}
+	return digests[0], nil
+}
+
+// ImageConfigDigest returns the digest of the configuration of the image
+// ref, which is its ID.
+func (d *Daemon) ImageConfigDigest(ref string) (string, error) {
+	out, err := d.Cmd("inspect", "--type", "image", "-f", "{{.Id}}", ref)
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to inspect %s: %s", d.id, ref, strings.TrimSpace(out))
+	}
+	dgst, err := digest.ParseDigest(strings.TrimSpace(out))
+	if err != nil {
+		return "", fmt.Errorf("[%s] image %s: %v", d.id, ref, err)
+	}
+	return dgst.String(), nil
+}
+
+// WaitForImage waits until ref is available on the daemon, e.g. after a pull
+// running in the background, or fails after timeout.
+func (d *Daemon) WaitForImage(ref string, timeout time.Duration) error {
+	after := time.After(timeout)
+	for {
+		out, err := d.Cmd("inspect", "--type", "image", "-f", "{{.Id}}", ref)
+		if err == nil {
+			return nil
+		}
+		if !strings.Contains(out, "No such image") {
+			return fmt.Errorf("[%s] failed to inspect %s: %s", d.id, ref, out)
+		}
+		select {
+		case <-after:
+			return fmt.Errorf("[%s] image %s not available after %v", d.id, ref, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// CopyToContainer copies the file or directory src of the host to destPath
+// in the container.
+func (d *Daemon) CopyToContainer(containerID, src, destPath string) error {
+	if out, err := d.Cmd("cp", src, containerID+":"+destPath); err != nil {
+		return fmt.Errorf("[%s] could not copy %s to %s:%s: %s", d.id, src, containerID, destPath, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// CopyFromContainer copies the file or directory srcPath of the container to
+// dest on the host.
+func (d *Daemon) CopyFromContainer(containerID, srcPath, dest string) error {
+	if out, err := d.Cmd("cp", containerID+":"+srcPath, dest); err != nil {
+		return fmt.Errorf("[%s] could not copy %s:%s to %s: %s", d.id, containerID, srcPath, dest, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// InspectContainer returns the inspect information of a container.
+func (d *Daemon) InspectContainer(containerID string) (types.ContainerJSON, error) {
+	var ctr types.ContainerJSON
+	status, body, err := d.SockRequest("GET", "/containers/"+containerID+"/json", nil)
+	if err != nil {
+		return ctr, err
+	}
+	if status != http.StatusOK {
+		return ctr, fmt.Errorf("[%s] unexpected status %d inspecting %s: %s", d.id, status, containerID, body)
+	}
+	err = json.Unmarshal(body, &ctr)
+	return ctr, err
+}
+
+// NetworkInspect returns the configuration of a network, including its
+// IPAM configuration and the containers connected to it.
+func (d *Daemon) NetworkInspect(name string) (types.NetworkResource, error) {
+	var v types.NetworkResource
+	status, body, err := d.SockRequest("GET", "/networks/"+name, nil)
+	if err != nil {
+		return v, err
+	}
+	if status != http.StatusOK {
+		return v, fmt.Errorf("[%s] unexpected status %d inspecting network %s: %s", d.id, status, name, body)
+	}
+	err = json.Unmarshal(body, &v)
+	return v, err
+}
+
+// ContainerDiff returns the changes to the filesystem of a container. Kind
+// is 0 for a modified, 1 for an added and 2 for a deleted path.
+func (d *Daemon) ContainerDiff(containerID string) ([]types.ContainerChange, error) {
+	var v []types.ContainerChange
+	status, body, err := d.SockRequest("GET", "/containers/"+containerID+"/changes", nil)
+	if err != nil {
+		return v, err
+	}
+	if status != http.StatusOK {
+		return v, fmt.Errorf("[%s] unexpected status %d getting changes of %s: %s", d.id, status, containerID, body)
+	}
+	err = json.Unmarshal(body, &v)
+	return v, err
+}
+
+// ContainerTop lists the processes running in a container. psArgs are
+// passed to ps and determine the titles and columns of the result.
+func (d *Daemon) ContainerTop(containerID string, psArgs ...string) (types.ContainerProcessList, error) {
+	var v types.ContainerProcessList
+	endpoint := "/containers/" + containerID + "/top"
+	if len(psArgs) > 0 {
+		endpoint += "?" + url.Values{"ps_args": {strings.Join(psArgs, " ")}}.Encode()
+	}
+	status, body, err := d.SockRequest("GET", endpoint, nil)
+	if err != nil {
+		return v, err
+	}
+	if status != http.StatusOK {
+		return v, fmt.Errorf("[%s] unexpected status %d listing processes of %s: %s", d.id, status, containerID, body)
+	}
+	err = json.Unmarshal(body, &v)
+	return v, err
+}
+
+// Attach attaches stdin and stdout to a running container until the
+// container exits or ctx is cancelled, which detaches. Both the stdout and
+// the stderr of the container are written to stdout. stdin may be nil.
+func (d *Daemon) Attach(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer) error {
+	ctr, err := d.InspectContainer(containerID)
+	if err != nil {
+		return err
+	}
+
+	conn, br, err := d.hijack("POST", "/containers/"+containerID+"/attach?stream=1&stdin=1&stdout=1&stderr=1")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(conn, stdin)
+			if cw, ok := conn.(interface {
+				CloseWrite() error
+			}); ok {
+				cw.CloseWrite()
+			}
+		}()
+	}
+
+	// closing the connection ends the copy below when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// without a TTY the output is multiplexed with stdcopy
+	if ctr.Config.Tty {
+		_, err = io.Copy(stdout, br)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stdout, br)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// hijack sends a request to the daemon API and takes over the connection
+// for streaming, as done by attach. Like APICall, it uses APIVersion.
+func (d *Daemon) hijack(method, endpoint string) (net.Conn, *bufio.Reader, error) {
+	if err := d.checkAPIVersion(); err != nil {
+		return nil, nil, err
+	}
+	if d.APIVersion != "" {
+		endpoint = "/v" + d.APIVersion + endpoint
+	}
+	clientConfig, err := d.getClientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := clientConfig.transport.Dial("tcp", clientConfig.addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not dial docker daemon: %v", err)
+	}
+	if clientConfig.scheme == "https" {
+		// unlike http.Transport, tls.Client does not take the name to verify
+		// the server certificate against from the address; the config is
+		// created for this connection only, so it can be changed
+		tlsConfig := clientConfig.transport.TLSClientConfig
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(clientConfig.addr)
+			if err != nil {
+				conn.Close()
+				return nil, nil, err
+			}
+			tlsConfig.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("[%s] TLS handshake with the daemon failed: %v", d.id, err)
+		}
+		conn = tlsConn
+	}
+
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not create new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Host = clientConfig.addr
+
+	client := httputil.NewClientConn(conn, nil)
+	resp, err := client.Do(req)
+	if err != nil && err != httputil.ErrPersistEOF {
+		client.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		client.Close()
+		return nil, nil, fmt.Errorf("[%s] unexpected status %d for %s %s: %s", d.id, resp.StatusCode, method, endpoint, bytes.TrimSpace(b))
+	}
+	conn, br := client.Hijack()
+	return conn, br, nil
+}
+
+// ContainerStats returns a single stats sample of a running container.
+func (d *Daemon) ContainerStats(containerID string) (types.StatsJSON, error) {
+	var v types.StatsJSON
+	status, body, err := d.SockRequest("GET", "/containers/"+containerID+"/stats?stream=0", nil)
+	if err != nil {
+		return v, err
+	}
+	if status != http.StatusOK {
+		return v, fmt.Errorf("[%s] unexpected status %d getting stats of %s: %s", d.id, status, containerID, body)
+	}
+	err = json.Unmarshal(body, &v)
+	return v, err
+}
+
+// ContainerStatsStream streams the stats of a running container until ctx
+// is cancelled or the stream ends, after which the returned channel is
+// closed.
+func (d *Daemon) ContainerStatsStream(ctx context.Context, containerID string) (<-chan types.StatsJSON, error) {
+	resp, body, err := d.SockRequestRaw("GET", "/containers/"+containerID+"/stats?stream=1", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := readBody(body)
+		return nil, fmt.Errorf("[%s] unexpected status %d streaming stats of %s: %s", d.id, resp.StatusCode, containerID, b)
+	}
+
+	// closing the body unblocks the decoder when ctx is done
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		body.Close()
+	}()
+
+	stats := make(chan types.StatsJSON)
+	go func() {
+		defer close(stats)
+		defer close(done)
+		dec := json.NewDecoder(body)
+		for {
+			var v types.StatsJSON
+			if err := dec.Decode(&v); err != nil {
+				return
+			}
+			select {
+			case stats <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stats, nil
+}
+
+// CountEvents counts the events of the given type and action that the
+// daemon logs during window, starting from the time of the call. An empty
+// eventType or action matches any. The window is half-open: an event is
+// counted if its timestamp is at or after the start and strictly before the
+// end. It returns early with ctx's error if ctx is cancelled.
+func (d *Daemon) CountEvents(ctx context.Context, eventType, action string, window time.Duration) (int, error) {
+	start := time.Now()
+	end := start.Add(window)
+
+	args := filters.NewArgs()
+	if eventType != "" {
+		args.Add("type", eventType)
+	}
+	if action != "" {
+		args.Add("event", action)
+	}
+	query := url.Values{}
+	query.Set("since", parseEventTime(start))
+	// the daemon ends the stream once until has passed
+	query.Set("until", parseEventTime(end))
+	if args.Len() > 0 {
+		filterJSON, err := filters.ToParam(args)
+		if err != nil {
+			return 0, err
+		}
+		query.Set("filters", filterJSON)
+	}
+
+	resp, body, err := d.SockRequestRaw("GET", "/events?"+query.Encode(), nil, "")
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := readBody(body)
+		return 0, fmt.Errorf("[%s] unexpected status %d getting events: %s", d.id, resp.StatusCode, b)
+	}
+
+	// closing the body unblocks the decoder when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		body.Close()
+	}()
+
+	var count int
+	dec := json.NewDecoder(body)
+	for {
+		var ev eventtypes.Message
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return count, ctx.Err()
+			}
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+		if ev.TimeNano >= start.UnixNano() && ev.TimeNano < end.UnixNano() {
+			count++
+		}
+	}
+}
+
+// ListImages lists the images matching opts, like docker images.
+// Intermediate images of builds are only listed if opts.All is set.
+func (d *Daemon) ListImages(opts types.ImageListOptions) ([]types.Image, error) {
+	query := url.Values{}
+	if opts.Filters.Len() > 0 {
+		filterJSON, err := filters.ToParam(opts.Filters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", filterJSON)
+	}
+	if opts.MatchName != "" {
+		query.Set("filter", opts.MatchName)
+	}
+	if opts.All {
+		query.Set("all", "1")
+	}
+
+	status, body, err := d.SockRequest("GET", "/images/json?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("[%s] unexpected status %d listing images: %s", d.id, status, body)
+	}
+
+	var images []types.Image
+	if err := json.Unmarshal(body, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// InspectImage returns the inspect information of an image, given by ID or
+// reference.
+func (d *Daemon) InspectImage(ref string) (types.ImageInspect, error) {
+	var img types.ImageInspect
+	status, body, err := d.SockRequest("GET", "/images/"+ref+"/json", nil)
+	if err != nil {
+		return img, err
+	}
+	if status != http.StatusOK {
+		return img, fmt.Errorf("[%s] unexpected status %d inspecting image %s: %s", d.id, status, ref, body)
+	}
+	err = json.Unmarshal(body, &img)
+	return img, err
+}
+
+// ImageHistory returns the history of an image, given by ID or reference,
+// newest layer first.
+func (d *Daemon) ImageHistory(ref string) ([]types.ImageHistory, error) {
+	var history []types.ImageHistory
+	status, body, err := d.SockRequest("GET", "/images/"+ref+"/history", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("[%s] unexpected status %d getting history of image %s: %s", d.id, status, ref, body)
+	}
+	err = json.Unmarshal(body, &history)
+	return history, err
+}
+
+// RenameContainer renames a container. On failure, e.g. because newName is
+// taken, the error holds the message of the daemon.
+func (d *Daemon) RenameContainer(containerID, newName string) error {
+	if out, err := d.Cmd("rename", containerID, newName); err != nil {
+		return fmt.Errorf("[%s] could not rename %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// PauseContainer pauses all processes of a running container.
+func (d *Daemon) PauseContainer(containerID string) error {
+	if out, err := d.Cmd("pause", containerID); err != nil {
+		return fmt.Errorf("[%s] could not pause %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// UnpauseContainer resumes a paused container.
+func (d *Daemon) UnpauseContainer(containerID string) error {
+	if out, err := d.Cmd("unpause", containerID); err != nil {
+		return fmt.Errorf("[%s] could not unpause %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// KillContainer sends signal, e.g. "SIGTERM" or "15", to the main process
+// of a container. An empty signal sends the default SIGKILL.
+func (d *Daemon) KillContainer(containerID, signal string) error {
+	args := []string{containerID}
+	if signal != "" {
+		args = []string{"--signal", signal, containerID}
+	}
+	if out, err := d.Cmd("kill", args...); err != nil {
+		return fmt.Errorf("[%s] could not kill %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
+}
 
-func (d *Daemon) getBaseDeviceSize(c *check.C) int64 {
-	infoCmdOutput, _, err := runCommandPipelineWithOutput(
-		exec.Command(dockerBinary, "-H", d.sock(), "info"),
-		exec.Command("grep", "Base Device Size"),
-	)
-	c.Assert(err, checker.IsNil)
-	basesizeSlice := strings.Split(infoCmdOutput, ":")
-	basesize := strings.Trim(basesizeSlice[1], " ")
-	basesize = strings.Trim(basesize, "\n")[:len(basesize)-3]
-	basesizeFloat, err := strconv.ParseFloat(strings.Trim(basesize, " "), 64)
-	c.Assert(err, checker.IsNil)
-	basesizeBytes := int64(basesizeFloat) * (1024 * 1024 * 1024)
-	return basesizeBytes
+// StopContainer stops a container, killing it if it has not exited timeout
+// seconds after receiving its stop signal.
+func (d *Daemon) StopContainer(containerID string, timeout int) error {
+	if out, err := d.Cmd("stop", "--time", strconv.Itoa(timeout), containerID); err != nil {
+		return fmt.Errorf("[%s] could not stop %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
 }
 
-// Cmd will execute a docker CLI command against this Daemon.
-// Example: d.Cmd("version") will run docker -H unix://path/to/unix.sock version
-func (d *Daemon) Cmd(name string, arg ...string) (string, error) {
-	args := []string{"--host", d.sock(), name}
-	args = append(args, arg...)
-	c := exec.Command(dockerBinary, args...)
-	b, err := c.CombinedOutput()
-	return string(b), err
+// RestartContainer restarts a container, killing it if it has not exited
+// timeout seconds after receiving its stop signal.
+func (d *Daemon) RestartContainer(containerID string, timeout int) error {
+	if out, err := d.Cmd("restart", "--time", strconv.Itoa(timeout), containerID); err != nil {
+		return fmt.Errorf("[%s] could not restart %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
 }
 
-// CmdWithArgs will execute a docker CLI command against a daemon with the
-// given additional arguments
-func (d *Daemon) CmdWithArgs(daemonArgs []string, name string, arg ...string) (string, error) {
-	args := append(daemonArgs, name)
-	args = append(args, arg...)
-	c := exec.Command(dockerBinary, args...)
-	b, err := c.CombinedOutput()
-	return string(b), err
+// ContainerRestartCount returns how often the daemon restarted a container
+// because of its restart policy.
+func (d *Daemon) ContainerRestartCount(containerID string) (int, error) {
+	out, err := d.inspectFilter(containerID, ".RestartCount")
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(out)
+}
+
+// ResizeContainer resizes the TTY of a running container.
+func (d *Daemon) ResizeContainer(containerID string, height, width int) error {
+	query := url.Values{"h": {strconv.Itoa(height)}, "w": {strconv.Itoa(width)}}
+	return d.APICallJSON("POST", "/containers/"+containerID+"/resize?"+query.Encode(), nil, nil)
+}
+
+// ResizeExec resizes the TTY of a running exec.
+func (d *Daemon) ResizeExec(execID string, height, width int) error {
+	query := url.Values{"h": {strconv.Itoa(height)}, "w": {strconv.Itoa(width)}}
+	return d.APICallJSON("POST", "/exec/"+execID+"/resize?"+query.Encode(), nil, nil)
+}
+
+// ExecDetach starts cmd in the running container without waiting for it,
+// and returns the exec ID to pass to ExecInspect.
+func (d *Daemon) ExecDetach(containerID string, cmd ...string) (string, error) {
+	var created types.ContainerExecCreateResponse
+	config := types.ExecConfig{Cmd: cmd}
+	if err := d.APICallJSON("POST", "/containers/"+containerID+"/exec", config, &created); err != nil {
+		return "", err
+	}
+	start := types.ExecStartCheck{Detach: true}
+	if err := d.APICallJSON("POST", "/exec/"+created.ID+"/start", start, nil); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// ExecInspect returns the state of an exec. It does not wait for the exec to
+// finish: while it is running, Running is true and ExitCode is 0.
+func (d *Daemon) ExecInspect(execID string) (types.ContainerExecInspect, error) {
+	var inspect struct {
+		ID          string
+		ContainerID string
+		Running     bool
+		ExitCode    *int
+	}
+	if err := d.APICallJSON("GET", "/exec/"+execID+"/json", nil, &inspect); err != nil {
+		return types.ContainerExecInspect{}, err
+	}
+	result := types.ContainerExecInspect{
+		ExecID:      inspect.ID,
+		ContainerID: inspect.ContainerID,
+		Running:     inspect.Running,
+	}
+	if inspect.ExitCode != nil {
+		result.ExitCode = *inspect.ExitCode
+	}
+	return result, nil
+}
+
+// UpdateContainer runs docker update on a container with the given options.
+func (d *Daemon) UpdateContainer(containerID string, opts ...string) error {
+	args := append(append([]string{}, opts...), containerID)
+	if out, err := d.Cmd("update", args...); err != nil {
+		return fmt.Errorf("[%s] could not update %s: %s", d.id, containerID, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// UpdateContainerResources updates the resources of a container through the
+// remote API.
+func (d *Daemon) UpdateContainerResources(containerID string, resources container.UpdateConfig) error {
+	status, body, err := d.SockRequest("POST", "/containers/"+containerID+"/update", resources)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("[%s] unexpected status %d updating %s: %s", d.id, status, containerID, body)
+	}
+	return nil
+}
+
+// TailLog returns the last n lines of the daemon log, or all of them if
+// there are fewer. The log is read backwards from its end.
+func (d *Daemon) TailLog(n int) ([]string, error) {
+	f, err := os.Open(d.logPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunkSize = 4096
+	var buf []byte
+	offset := fi.Size()
+	// one more newline than requested ensures the first line is complete
+	for offset > 0 && bytes.Count(bytes.TrimRight(buf, "\n"), []byte{'\n'}) < n {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+	}
+
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 || n <= 0 {
+		return nil, nil
+	}
+	lines := strings.Split(string(buf), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// logTail formats the end of the daemon log for error messages.
+func (d *Daemon) logTail() string {
+	lines, err := d.TailLog(errorLogLines)
+	if err != nil || len(lines) == 0 {
+		return ""
+	}
+	return "\nlast daemon log lines:\n" + strings.Join(lines, "\n")
+}
+
+// LogEntries parses the daemon log as one JSON object per line, as written
+// by a JSON log formatter. Lines that are not JSON objects are skipped.
+func (d *Daemon) LogEntries() ([]map[string]interface{}, error) {
+	f, err := os.Open(d.logPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// LogEntriesWhere returns the JSON log entries at the given level whose
+// message contains msgSubstring. An empty level matches any level.
+func (d *Daemon) LogEntriesWhere(level, msgSubstring string) ([]map[string]interface{}, error) {
+	entries, err := d.LogEntries()
+	if err != nil {
+		return nil, err
+	}
+	var matched []map[string]interface{}
+	for _, entry := range entries {
+		if l, _ := entry["level"].(string); level != "" && l != level {
+			continue
+		}
+		if msg, _ := entry["msg"].(string); !strings.Contains(msg, msgSubstring) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	return matched, nil
+}
+
+// logPath returns the path of the file the daemon logs to.
+func (d *Daemon) logPath() string {
+	if d.logFile != nil {
+		return d.logFile.Name()
+	}
+	return filepath.Join(d.folder, "docker.log")
 }
 
 // LogFileName returns the path the the daemon's log file
@@ -462,6 +3371,107 @@ func (d *Daemon) LogFileName() string {
 	return d.logFile.Name()
 }
 
+// CollectDiagnostics writes what's needed to investigate a failure of the
+// daemon into a new directory in destDir, named after the daemon and the
+// current time: the daemon log, a dump of its goroutine stacks, its /info and
+// its containers, images and networks. Whatever can't be collected, e.g.
+// because the daemon crashed, is listed in errors.txt instead of failing the
+// collection; only failing to create the directory is an error.
+func (d *Daemon) CollectDiagnostics(destDir string) error {
+	dir := filepath.Join(destDir, fmt.Sprintf("%s-%s", d.id, time.Now().Format("20060102-150405")))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var failures []string
+	collect := func(name string, get func() ([]byte, error)) {
+		b, err := get()
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name), b, 0644)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	for _, r := range []struct{ name, endpoint string }{
+		{"info.json", "/info"},
+		{"containers.json", "/containers/json?all=1"},
+		{"images.json", "/images/json?all=1"},
+		{"networks.json", "/networks"},
+	} {
+		endpoint := r.endpoint
+		collect(r.name, func() ([]byte, error) {
+			status, body, err := d.SockRequest("GET", endpoint, nil)
+			if err != nil {
+				return nil, err
+			}
+			if status != http.StatusOK {
+				return nil, fmt.Errorf("unexpected status %d: %s", status, body)
+			}
+			return body, nil
+		})
+	}
+	// the stacks are dumped to the log, which is copied afterwards
+	collect("goroutine-stacks.txt", d.dumpStacks)
+	collect("daemon.log", func() ([]byte, error) {
+		return ioutil.ReadFile(d.logPath())
+	})
+
+	if len(failures) > 0 {
+		return ioutil.WriteFile(filepath.Join(dir, "errors.txt"), []byte(strings.Join(failures, "\n")+"\n"), 0644)
+	}
+	return nil
+}
+
+// stackDumpTimeout is how long dumpStacks waits for the daemon to log the
+// stacks of its goroutines.
+const stackDumpTimeout = 5 * time.Second
+
+// stackDumpBegin starts the message the daemon logs its goroutine stacks in.
+const stackDumpBegin = "=== BEGIN goroutine stack dump ==="
+
+// dumpStacks makes the running daemon log the stacks of all its goroutines,
+// without stopping it, and returns the logged message. The daemon only logs
+// it at the info level or below.
+func (d *Daemon) dumpStacks() ([]byte, error) {
+	if d.cmd == nil {
+		return nil, errors.New("daemon not started")
+	}
+	fi, err := os.Stat(d.logPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := d.signalStackDump(); err != nil {
+		return nil, err
+	}
+
+	after := time.After(stackDumpTimeout)
+	for {
+		b, err := ioutil.ReadFile(d.logPath())
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) > fi.Size() {
+			for _, line := range strings.Split(string(b[fi.Size():]), "\n") {
+				if _, msg, ok := parseLogLine(line); ok && strings.HasPrefix(msg, stackDumpBegin) {
+					// text log messages are quoted
+					if !strings.HasPrefix(line, "{") {
+						if unquoted, err := strconv.Unquote(`"` + msg + `"`); err == nil {
+							msg = unquoted
+						}
+					}
+					return []byte(msg), nil
+				}
+			}
+		}
+		select {
+		case <-after:
+			return nil, fmt.Errorf("[%s] daemon logged no stack dump within %v", d.id, stackDumpTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 func (d *Daemon) getIDByName(name string) (string, error) {
 	return d.inspectFieldWithError(name, "Id")
 }
@@ -475,6 +3485,34 @@ func (d *Daemon) inspectFilter(name, filter string) (string, error) {
 	return strings.TrimSpace(out), nil
 }
 
+// InspectJSON inspects the container, image, network or volume ref and
+// unmarshals the result into out.
+func (d *Daemon) InspectJSON(ref string, out interface{}) error {
+	var (
+		output string
+		err    error
+	)
+	for _, cmd := range [][]string{{"inspect"}, {"network", "inspect"}, {"volume", "inspect"}} {
+		output, err = d.Cmd(cmd[0], append(cmd[1:], ref)...)
+		if err == nil || !strings.Contains(output, "No such") {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("[%s] failed to inspect %s: %s", d.id, ref, output)
+	}
+
+	// inspect always returns a list, even for a single object
+	var objects []json.RawMessage
+	if err := json.Unmarshal([]byte(output), &objects); err != nil {
+		return err
+	}
+	if len(objects) != 1 {
+		return fmt.Errorf("[%s] expected one object inspecting %s, got %d", d.id, ref, len(objects))
+	}
+	return json.Unmarshal(objects[0], out)
+}
+
 func (d *Daemon) inspectFieldWithError(name, field string) (string, error) {
 	return d.inspectFilter(name, fmt.Sprintf(".%s", field))
 }
@@ -487,7 +3525,368 @@ func (d *Daemon) findContainerIP(id string) string {
 	return strings.Trim(out, " \r\n'")
 }
 
+// WaitForContainerIP waits up to timeout for a container to get an IP
+// address on the given network and returns it.
+func (d *Daemon) WaitForContainerIP(id, network string, timeout time.Duration) (string, error) {
+	filter := fmt.Sprintf("(index .NetworkSettings.Networks %q).IPAddress", network)
+	after := time.After(timeout)
+	for {
+		ip, err := d.inspectFilter(id, filter)
+		if err == nil && ip != "" && ip != "<no value>" {
+			return ip, nil
+		}
+		select {
+		case <-after:
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("[%s] container %s got no IP on network %s within %v", d.id, id, network, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// ContainerCgroupParent returns the cgroup parent a container was created
+// with. It's empty if the container uses the daemon's default.
+func (d *Daemon) ContainerCgroupParent(id string) (string, error) {
+	return d.inspectFilter(id, ".HostConfig.CgroupParent")
+}
+
+// ContainerPID returns the host process ID of the main process of a
+// running container.
+func (d *Daemon) ContainerPID(id string) (int, error) {
+	out, err := d.inspectFilter(id, ".State.Pid")
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, err
+	}
+	if pid == 0 {
+		return 0, fmt.Errorf("[%s] container %s is not running", d.id, id)
+	}
+	return pid, nil
+}
+
+// ContainerIPv6OnNetwork returns the global IPv6 address of a container on
+// the given network.
+func (d *Daemon) ContainerIPv6OnNetwork(id, network string) (string, error) {
+	return d.inspectFilter(id, fmt.Sprintf("(index .NetworkSettings.Networks %q).GlobalIPv6Address", network))
+}
+
+// defaultBridge is the bridge the daemon creates and attaches containers to
+// unless told to use another one with --bridge.
+const defaultBridge = "docker0"
+
+// BridgeInterface returns the name of the host bridge the running daemon
+// attaches containers of the default network to: the --bridge it was started
+// with, which BridgeName sets, or docker0. It fails if the bridge doesn't
+// exist on the host, e.g. because setting up networking failed.
+func (d *Daemon) BridgeInterface() (string, error) {
+	if d.cmd == nil {
+		return "", errors.New("daemon not started")
+	}
+	name := d.flagValue("-b", "--bridge")
+	switch name {
+	case "":
+		name = defaultBridge
+	case "none":
+		return "", fmt.Errorf("[%s] daemon was started without a bridge", d.id)
+	}
+	if _, err := net.InterfaceByName(name); err != nil {
+		return "", fmt.Errorf("[%s] bridge %s does not exist on the host: %v%s", d.id, name, err, d.logTail())
+	}
+	return name, nil
+}
+
+// ContainerResolvConf returns the /etc/resolv.conf of a running container.
+// On user-defined networks it points to the embedded DNS server at
+// 127.0.0.11, which forwards to the configured nameservers, instead of
+// listing them.
+func (d *Daemon) ContainerResolvConf(id string) (string, error) {
+	out, err := d.Cmd("exec", id, "cat", "/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not read resolv.conf of %s: %v\n%s", d.id, id, err, out)
+	}
+	return out, nil
+}
+
+// ContainerLogDriver returns the log driver a container is using, which is
+// either the daemon default or the one it was run with.
+func (d *Daemon) ContainerLogDriver(id string) (string, error) {
+	return d.inspectFilter(id, ".HostConfig.LogConfig.Type")
+}
+
+// ContainerLogPath returns the path of the log file the container's log
+// driver writes to, e.g. for json-file. Rotated files have the suffixes .1,
+// .2 and so on. Log drivers that don't write to a file are an error.
+func (d *Daemon) ContainerLogPath(id string) (string, error) {
+	out, err := d.inspectFilter(id, `printf "%s %s" .HostConfig.LogConfig.Type .LogPath`)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(out, " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("[%s] no log file for driver %s", d.id, parts[0])
+	}
+	return parts[1], nil
+}
+
+// ContainerDevices returns the host devices mapped into the container with
+// --device.
+func (d *Daemon) ContainerDevices(id string) ([]container.DeviceMapping, error) {
+	out, err := d.inspectFilter(id, "json .HostConfig.Devices")
+	if err != nil {
+		return nil, err
+	}
+	var devices []container.DeviceMapping
+	if err := json.Unmarshal([]byte(out), &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// ContainerEnv returns the environment the container was created with, which
+// combines the image ENV, --env-file and -e. If a variable is set more than
+// once, the last value wins.
+func (d *Daemon) ContainerEnv(id string) (map[string]string, error) {
+	out, err := d.inspectFilter(id, "json .Config.Env")
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	if err := json.Unmarshal([]byte(out), &entries); err != nil {
+		return nil, err
+	}
+	env := make(map[string]string, len(entries))
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env, nil
+}
+
+// ContainerMounts returns the volumes and bind mounts of the container, plus
+// its --tmpfs mounts, which inspect does not list among the mounts. Those are
+// reported with "tmpfs" as Source and their mount options as Mode.
+func (d *Daemon) ContainerMounts(id string) ([]types.MountPoint, error) {
+	var ctr struct {
+		Mounts     []types.MountPoint
+		HostConfig struct {
+			Tmpfs map[string]string
+		}
+	}
+	if err := d.InspectJSON(id, &ctr); err != nil {
+		return nil, err
+	}
+	mounts := ctr.Mounts
+	var tmpfs []string
+	for dest := range ctr.HostConfig.Tmpfs {
+		tmpfs = append(tmpfs, dest)
+	}
+	sort.Strings(tmpfs)
+	for _, dest := range tmpfs {
+		opts := ctr.HostConfig.Tmpfs[dest]
+		rw := true
+		for _, o := range strings.Split(opts, ",") {
+			if o == "ro" {
+				rw = false
+			}
+		}
+		mounts = append(mounts, types.MountPoint{
+			Source:      "tmpfs",
+			Destination: dest,
+			Mode:        opts,
+			RW:          rw,
+		})
+	}
+	return mounts, nil
+}
+
+// RunContainerWithAppArmor is like RunContainer, but confines the container
+// to the named AppArmor profile.
+func (d *Daemon) RunContainerWithAppArmor(image, profile string, opts ...string) (string, error) {
+	return d.RunContainer(image, append([]string{"--security-opt", "apparmor=" + profile}, opts...)...)
+}
+
+// ContainerAppArmorProfile returns the AppArmor profile the container is
+// confined to.
+func (d *Daemon) ContainerAppArmorProfile(id string) (string, error) {
+	return d.inspectFilter(id, ".AppArmorProfile")
+}
+
+// LoadAppArmorProfile loads the AppArmor profile at path into the host
+// kernel, replacing any profile of the same name. The profile is unloaded
+// again by the next Stop, Kill or Cleanup.
+func (d *Daemon) LoadAppArmorProfile(path string) error {
+	if err := aaparser.LoadProfile(path); err != nil {
+		return err
+	}
+	d.AddCleanup(func() error {
+		if out, err := exec.Command("apparmor_parser", "-R", path).CombinedOutput(); err != nil {
+			return fmt.Errorf("unloading AppArmor profile %s: %v: %s", path, err, out)
+		}
+		return nil
+	})
+	return nil
+}
+
+// ContainerSeccompMode returns the seccomp mode the container was created
+// with: "default" if no seccomp security option was given, "unconfined" if
+// seccomp was disabled and "custom" if a profile was supplied.
+func (d *Daemon) ContainerSeccompMode(id string) (string, error) {
+	var ctr struct {
+		HostConfig struct {
+			SecurityOpt []string
+		}
+	}
+	if err := d.InspectJSON(id, &ctr); err != nil {
+		return "", err
+	}
+	for _, opt := range ctr.HostConfig.SecurityOpt {
+		// both the "seccomp=" and the deprecated "seccomp:" forms are accepted
+		if !strings.HasPrefix(opt, "seccomp=") && !strings.HasPrefix(opt, "seccomp:") {
+			continue
+		}
+		if opt[len("seccomp="):] == "unconfined" {
+			return "unconfined", nil
+		}
+		return "custom", nil
+	}
+	return "default", nil
+}
+
+// ulimitNames maps the ulimit names used by docker to the limit names in
+// /proc/<pid>/limits.
+var ulimitNames = map[string]string{
+	"as":         "Max address space",
+	"core":       "Max core file size",
+	"cpu":        "Max cpu time",
+	"data":       "Max data size",
+	"fsize":      "Max file size",
+	"locks":      "Max file locks",
+	"memlock":    "Max locked memory",
+	"msgqueue":   "Max msgqueue size",
+	"nice":       "Max nice priority",
+	"nofile":     "Max open files",
+	"nproc":      "Max processes",
+	"rss":        "Max resident set",
+	"rtprio":     "Max realtime priority",
+	"rttime":     "Max realtime timeout",
+	"sigpending": "Max pending signals",
+	"stack":      "Max stack size",
+}
+
+// ContainerUlimit returns the soft and hard limit, e.g. of "nofile", that
+// applies to the main process of a running container. Unlimited is
+// reported as -1.
+func (d *Daemon) ContainerUlimit(id, name string) (soft, hard int64, err error) {
+	limitName, ok := ulimitNames[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown ulimit %q", name)
+	}
+	out, err := d.Cmd("exec", id, "cat", "/proc/1/limits")
+	if err != nil {
+		return 0, 0, fmt.Errorf("[%s] could not read limits of %s: %s", d.id, id, strings.TrimSpace(out))
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, limitName+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, limitName))
+		if len(fields) < 2 {
+			break
+		}
+		if soft, err = parseUlimitValue(fields[0]); err != nil {
+			return 0, 0, err
+		}
+		if hard, err = parseUlimitValue(fields[1]); err != nil {
+			return 0, 0, err
+		}
+		return soft, hard, nil
+	}
+	return 0, 0, fmt.Errorf("[%s] no %q in limits of %s:\n%s", d.id, limitName, id, out)
+}
+
+func parseUlimitValue(v string) (int64, error) {
+	if v == "unlimited" {
+		return -1, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// ContainerMTU returns the MTU of the eth0 interface of a running container.
+func (d *Daemon) ContainerMTU(id string) (int, error) {
+	out, err := d.Cmd("exec", id, "cat", "/sys/class/net/eth0/mtu")
+	if err != nil {
+		return -1, fmt.Errorf("[%s] could not read MTU of %s: %s", d.id, id, out)
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
 func (d *Daemon) buildImageWithOut(name, dockerfile string, useCache bool, buildFlags ...string) (string, int, error) {
 	buildCmd := buildImageCmdWithHost(name, dockerfile, d.sock(), useCache, buildFlags...)
 	return runCommandWithOutput(buildCmd)
 }
+
+// BuildFromURL builds the image name from the context the daemon downloads
+// from contextURL, which may be a Dockerfile or a context tar archive, and
+// returns the image ID along with the build output. buildFlags are passed to
+// docker build before the URL.
+func (d *Daemon) BuildFromURL(name, contextURL string, buildFlags ...string) (string, string, error) {
+	args := append([]string{"-t", name}, buildFlags...)
+	out, err := d.Cmd("build", append(args, contextURL)...)
+	if err != nil {
+		return "", out, fmt.Errorf("[%s] could not build %s from %s: %v\n%s", d.id, name, contextURL, err, out)
+	}
+	id, err := d.inspectFilter(name, ".Id")
+	return id, out, err
+}
+
+// BuildWithContext builds the image name from a context directory holding
+// files, keyed by their slash-separated path in the context, and returns the
+// image ID along with the build output. files usually includes "Dockerfile"
+// and may include ".dockerignore". buildFlags are passed to docker build
+// before the context directory, which is removed afterwards.
+func (d *Daemon) BuildWithContext(name string, files map[string]string, buildFlags ...string) (string, string, error) {
+	dir, err := ioutil.TempDir(d.folder, "build-context")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(dir)
+
+	for p, content := range files {
+		if path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "../") || path.Clean(p) == ".." {
+			return "", "", fmt.Errorf("[%s] build context file %q is outside the context", d.id, p)
+		}
+		fp := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return "", "", err
+		}
+		if err := ioutil.WriteFile(fp, []byte(content), 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	args := append([]string{"-t", name}, buildFlags...)
+	out, err := d.Cmd("build", append(args, dir)...)
+	if err != nil {
+		return "", out, fmt.Errorf("[%s] could not build %s: %v\n%s", d.id, name, err, out)
+	}
+	id, err := d.inspectFilter(name, ".Id")
+	return id, out, err
+}
+
+// BuildNoCache builds dockerfile as the image name without using the build
+// cache, and returns the build output.
+func (d *Daemon) BuildNoCache(name, dockerfile string, buildFlags ...string) (string, error) {
+	out, _, err := d.buildImageWithOut(name, dockerfile, false, buildFlags...)
+	if err != nil {
+		return out, fmt.Errorf("[%s] could not build %s: %v\n%s", d.id, name, err, out)
+	}
+	return out, nil
+}
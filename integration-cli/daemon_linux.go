@@ -0,0 +1,224 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/vishvananda/netlink"
+)
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat (USER_HZ),
+// which is 100 on all supported architectures.
+const clockTicks = 100
+
+// rlimitExec is the reexec name of the wrapper that sets resource limits
+// and then executes the daemon, as Go cannot set them for a child process.
+const rlimitExec = "docker-integration-rlimit-exec"
+
+func init() {
+	reexec.Register(rlimitExec, rlimitExecMain)
+}
+
+// setRlimits makes cmd run through the rlimitExec wrapper when d.Rlimits
+// are set. The wrapper replaces itself with the command, which keeps its
+// process ID.
+func (d *Daemon) setRlimits(cmd *exec.Cmd) error {
+	if len(d.Rlimits) == 0 {
+		return nil
+	}
+	args := []string{rlimitExec}
+	for _, l := range d.Rlimits {
+		args = append(args, fmt.Sprintf("%d:%d:%d", l.Resource, l.Soft, l.Hard))
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = reexec.Self()
+	return nil
+}
+
+// rlimitExecMain sets the limits given as resource:soft:hard arguments up to
+// "--", then executes the path following it with the remaining arguments.
+func rlimitExecMain() {
+	args := os.Args[1:]
+	for ; len(args) > 0 && args[0] != "--"; args = args[1:] {
+		var l Rlimit
+		if _, err := fmt.Sscanf(args[0], "%d:%d:%d", &l.Resource, &l.Soft, &l.Hard); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid resource limit %q: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Soft, Max: l.Hard}); err != nil {
+			fmt.Fprintf(os.Stderr, "could not set resource limit %q: %v\n", args[0], err)
+			os.Exit(1)
+		}
+	}
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s [resource:soft:hard...] -- path argv0 [arg...]\n", rlimitExec)
+		os.Exit(1)
+	}
+	err := syscall.Exec(args[1], args[2:], os.Environ())
+	fmt.Fprintf(os.Stderr, "could not execute %s: %v\n", args[1], err)
+	os.Exit(1)
+}
+
+// readResourceSample reads the memory and CPU usage of a process from
+// /proc/<pid>/stat.
+func readResourceSample(pid int) (ResourceSample, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ResourceSample{}, err
+	}
+	// the command name in the second field may contain spaces, the fields
+	// after it start with the state, see proc(5)
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 22 {
+		return ResourceSample{}, fmt.Errorf("unexpected format of /proc/%d/stat: %s", pid, stat)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return ResourceSample{}, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return ResourceSample{}, err
+	}
+	rssPages, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return ResourceSample{}, err
+	}
+	return ResourceSample{
+		Time:    time.Now(),
+		RSS:     rssPages * int64(syscall.Getpagesize()),
+		CPUTime: time.Duration(utime+stime) * time.Second / clockTicks,
+	}, nil
+}
+
+// ContainerCgroupPath returns the host directory of the cgroup the main
+// process of a running container is in. With the unified hierarchy of
+// cgroup v2 it's below /sys/fs/cgroup; with cgroup v1 the directory of the
+// memory hierarchy is returned, as every controller has its own tree there.
+func (d *Daemon) ContainerCgroupPath(id string) (string, error) {
+	pid, err := d.ContainerPID(id)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	paths := parseCgroupPaths(string(b))
+
+	// a v2 process has a single entry with no controllers, "0::/path"
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		p, ok := paths[""]
+		if !ok {
+			return "", fmt.Errorf("[%s] no cgroup v2 entry for container %s: %s", d.id, id, b)
+		}
+		return filepath.Join("/sys/fs/cgroup", p), nil
+	}
+
+	var p string
+	for controllers, path := range paths {
+		for _, c := range strings.Split(controllers, ",") {
+			if c == "memory" {
+				p = path
+			}
+		}
+	}
+	if p == "" {
+		return "", fmt.Errorf("[%s] no memory cgroup for container %s: %s", d.id, id, b)
+	}
+	mnt, root, err := cgroups.FindCgroupMountpointAndRoot("memory")
+	if err != nil {
+		return "", err
+	}
+	// the mount may be of a subtree only, e.g. in a container
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mnt, rel), nil
+}
+
+// ContainerHostUID returns the real user ID on the host of the main process
+// of a running container. It's only 0 for a root process when the daemon
+// does not remap users (UsernsRemap) or the container runs with
+// --userns=host.
+func (d *Daemon) ContainerHostUID(id string) (int, error) {
+	pid, err := d.ContainerPID(id)
+	if err != nil {
+		return -1, err
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return -1, err
+	}
+	// "Uid:" is followed by the real, effective, saved and filesystem UIDs
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return -1, fmt.Errorf("[%s] no Uid in /proc/%d/status of container %s", d.id, pid, id)
+}
+
+// HostInterface describes a network interface of the host.
+type HostInterface struct {
+	Name string
+	MTU  int
+	Up   bool
+	// Addrs are the IPv4 addresses of the interface.
+	Addrs []*net.IPNet
+	// Ports are the interfaces attached to it if it is a bridge, such as
+	// the host end of the veth pair of each container.
+	Ports []string
+}
+
+// BridgeHostInterface returns the host side attributes of the bridge
+// returned by BridgeInterface.
+func (d *Daemon) BridgeHostInterface() (HostInterface, error) {
+	name, err := d.BridgeInterface()
+	if err != nil {
+		return HostInterface{}, err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return HostInterface{}, fmt.Errorf("[%s] could not get link %s: %v", d.id, name, err)
+	}
+	attrs := link.Attrs()
+	iface := HostInterface{
+		Name: attrs.Name,
+		MTU:  attrs.MTU,
+		Up:   attrs.Flags&net.FlagUp != 0,
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return HostInterface{}, fmt.Errorf("[%s] could not get addresses of %s: %v", d.id, name, err)
+	}
+	for _, a := range addrs {
+		iface.Addrs = append(iface.Addrs, a.IPNet)
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return HostInterface{}, err
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex == attrs.Index {
+			iface.Ports = append(iface.Ports, l.Attrs().Name)
+		}
+	}
+	return iface, nil
+}
@@ -0,0 +1,70 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/kr/pty"
+)
+
+// defaultSock returns the protocol and address of the socket the daemon
+// listens on unless told otherwise.
+func (d *Daemon) defaultSock() (proto, addr string) {
+	return "unix", filepath.Join(d.folder, "docker.sock")
+}
+
+// signalStackDump makes the daemon log the stacks of its goroutines. Unlike
+// SIGQUIT, SIGUSR1 does not make it exit.
+func (d *Daemon) signalStackDump() error {
+	return d.cmd.Process.Signal(syscall.SIGUSR1)
+}
+
+// CmdWithTTY is like Cmd, but runs the CLI with a pseudo-terminal as its
+// standard streams, as in an interactive shell. The output is returned as
+// written to the terminal, with \r\n line endings.
+func (d *Daemon) CmdWithTTY(name string, arg ...string) (string, error) {
+	if err := d.checkAPIVersion(); err != nil {
+		return "", err
+	}
+	args := append([]string{"--host", d.sock(), name}, arg...)
+	c := exec.Command(dockerBinary, args...)
+	c.Env = d.cmdEnv()
+	tty, err := pty.Start(c)
+	if err != nil {
+		return "", fmt.Errorf("[%s] could not run docker %s with a tty: %v", d.id, name, err)
+	}
+	defer tty.Close()
+
+	// reading fails with EIO once the CLI exited and closed the terminal
+	var out bytes.Buffer
+	io.Copy(&out, tty)
+	return out.String(), c.Wait()
+}
+
+// dockerIptablesChains returns the chains named DOCKER or DOCKER-* that
+// exist in the iptables table, e.g. "filter" or "nat". The chains are shared
+// by all daemons of the host.
+func dockerIptablesChains(table string) ([]string, error) {
+	out, err := exec.Command("iptables", "-t", table, "-S").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("could not list iptables %s chains: %v: %s", table, err, out)
+	}
+	var chains []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "-N" && fields[0] != "-P") {
+			continue
+		}
+		if fields[1] == "DOCKER" || strings.HasPrefix(fields[1], "DOCKER-") {
+			chains = append(chains, fields[1])
+		}
+	}
+	return chains, nil
+}
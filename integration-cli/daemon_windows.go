@@ -0,0 +1,34 @@
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// defaultSock returns the protocol and address of the named pipe the daemon
+// listens on unless told otherwise.
+func (d *Daemon) defaultSock() (proto, addr string) {
+	return "npipe", `\\.\pipe\docker_` + d.id
+}
+
+// setRlimits fails if any resource limits are set, as they are not
+// supported on Windows.
+func (d *Daemon) setRlimits(cmd *exec.Cmd) error {
+	if len(d.Rlimits) > 0 {
+		return errors.New("resource limits are not supported on Windows")
+	}
+	return nil
+}
+
+// readResourceSample is not supported on Windows.
+func readResourceSample(pid int) (ResourceSample, error) {
+	return ResourceSample{}, errors.New("resource sampling is not supported on Windows")
+}
+
+// signalStackDump is not supported on Windows, where the daemon dumps its
+// stacks when a named event is set.
+func (d *Daemon) signalStackDump() error {
+	return errors.New("stack dumps are not supported on Windows")
+}
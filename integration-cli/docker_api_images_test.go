@@ -127,3 +127,31 @@ func (s *DockerSuite) TestApiImagesSearchJSONContentType(c *check.C) {
 	c.Assert(res.StatusCode, checker.Equals, http.StatusOK)
 	c.Assert(res.Header.Get("Content-Type"), checker.Equals, "application/json")
 }
+
+func (s *DockerDaemonSuite) TestDaemonImageHistory(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	name := "historytest"
+	out, _, err := s.d.buildImageWithOut(name, `FROM busybox
+RUN echo foo > /foo
+RUN echo bar > /bar`, true)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	img, err := s.d.InspectImage(name)
+	c.Assert(err, checker.IsNil)
+
+	// by tag and by ID
+	for _, ref := range []string{name, img.ID} {
+		history, err := s.d.ImageHistory(ref)
+		c.Assert(err, checker.IsNil)
+
+		var layers int
+		for _, h := range history {
+			if strings.Contains(h.CreatedBy, "echo") && h.Size > 0 {
+				layers++
+			}
+		}
+		c.Assert(layers, checker.Equals, 2)
+		c.Assert(history[0].ID, checker.Equals, img.ID)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/versions"
 	"github.com/go-check/check"
+	"golang.org/x/net/context"
 )
 
 var expectedNetworkInterfaceStats = strings.Split("rx_bytes rx_dropped rx_errors rx_packets tx_bytes tx_dropped tx_errors tx_packets", " ")
@@ -279,3 +280,38 @@ func (s *DockerSuite) TestApiStatsNoStreamConnectedContainers(c *check.C) {
 		c.Fatalf("Stats did not return after timeout")
 	}
 }
+
+func (s *DockerDaemonSuite) TestDaemonContainerStats(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	out, err := s.d.Cmd("run", "-d", "-m", "64M", "busybox", "sh", "-c", "head -c 16m /dev/zero | tail; top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+
+	v, err := s.d.ContainerStats(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(v.MemoryStats.Usage, checker.GreaterThan, uint64(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := s.d.ContainerStatsStream(ctx, id)
+	c.Assert(err, checker.IsNil)
+	for i := 0; i < 2; i++ {
+		select {
+		case v, ok := <-stream:
+			c.Assert(ok, checker.True)
+			c.Assert(v.MemoryStats.Usage, checker.GreaterThan, uint64(0))
+			c.Assert(v.MemoryStats.Usage, checker.LessOrEqualThan, uint64(64*1024*1024))
+		case <-time.After(10 * time.Second):
+			c.Fatal("timeout waiting for stats")
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-stream:
+		for ok {
+			_, ok = <-stream
+		}
+	case <-time.After(10 * time.Second):
+		c.Fatal("stats stream was not closed after cancel")
+	}
+}
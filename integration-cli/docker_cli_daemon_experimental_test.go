@@ -193,3 +193,12 @@ func (s *DockerDaemonSuite) TestDaemonRestartWithUnpausedRunningContainer(t *che
 		t.Fatalf("Expected exit code '%s' got '%s' for container '%s'\n", "running", out, cid)
 	}
 }
+
+func (s *DockerDaemonSuite) TestDaemonExperimentalField(c *check.C) {
+	s.d.Experimental = true
+	c.Assert(s.d.Start(), check.IsNil)
+
+	info, err := s.d.Info()
+	c.Assert(err, check.IsNil)
+	c.Assert(info.ExperimentalBuild, check.Equals, true)
+}
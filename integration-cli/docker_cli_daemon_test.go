@@ -3,12 +3,22 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -22,11 +32,15 @@ import (
 
 	"github.com/docker/docker/pkg/integration/checker"
 	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/tlsconfig"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/go-units"
 	"github.com/docker/libnetwork/iptables"
 	"github.com/docker/libtrust"
 	"github.com/go-check/check"
 	"github.com/kr/pty"
+	"golang.org/x/net/context"
 )
 
 func (s *DockerDaemonSuite) TestDaemonRestartWithRunningContainersPorts(c *check.C) {
@@ -438,6 +452,28 @@ func (s *DockerDaemonSuite) TestDaemonIPv6FixedCIDR(c *check.C) {
 	c.Assert(err, checker.IsNil, check.Commentf("Could not perform teardown for IPv6 tests"))
 }
 
+func (s *DockerDaemonSuite) TestDaemonEnableIPv6(c *check.C) {
+	// IPv6 setup is messing with local bridge address.
+	testRequires(c, SameHostDaemon)
+	c.Assert(s.d.EnableIPv6("10.0.0.0/24"), checker.NotNil)
+	c.Assert(s.d.EnableIPv6("2001:db8:3::/64"), checker.IsNil)
+
+	err := setupV6()
+	c.Assert(err, checker.IsNil, check.Commentf("Could not set up host for IPv6 tests"))
+	defer func() {
+		c.Assert(teardownV6(), checker.IsNil, check.Commentf("Could not perform teardown for IPv6 tests"))
+	}()
+
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	ip, err := s.d.ContainerIPv6OnNetwork(strings.TrimSpace(out), "bridge")
+	c.Assert(err, checker.IsNil)
+	_, subnet, _ := net.ParseCIDR("2001:db8:3::/64")
+	c.Assert(subnet.Contains(net.ParseIP(ip)), checker.True, check.Commentf("%s is not in %s", ip, subnet))
+}
+
 // TestDaemonIPv6FixedCIDRAndMac checks that when the daemon is started with ipv6 fixed CIDR
 // the running containers are given a an IPv6 address derived from the MAC address and the ipv6 fixed CIDR
 func (s *DockerDaemonSuite) TestDaemonIPv6FixedCIDRAndMac(c *check.C) {
@@ -645,6 +681,19 @@ func (s *DockerDaemonSuite) TestDaemonBridgeExternal(c *check.C) {
 			containerIP))
 }
 
+func (s *DockerDaemonSuite) TestDaemonBridgeMTU(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	s.d.BridgeMTU = 1400
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	mtu, err := s.d.ContainerMTU(strings.TrimSpace(out))
+	c.Assert(err, checker.IsNil)
+	c.Assert(mtu, checker.Equals, 1400)
+}
+
 func createInterface(c *check.C, ifType string, ifName string, ipNet string) (string, error) {
 	args := []string{"link", "add", "name", ifName, "type", ifType}
 	ipLinkCmd := exec.Command("ip", args...)
@@ -1131,7 +1180,7 @@ func (s *DockerDaemonSuite) TestDaemonLoggingDriverDefault(c *check.C) {
 	id, err := s.d.getIDByName("test")
 	c.Assert(err, check.IsNil)
 
-	logPath := filepath.Join(s.d.root, "containers", id, id+"-json.log")
+	logPath := filepath.Join(s.d.rootDir(), "containers", id, id+"-json.log")
 
 	if _, err := os.Stat(logPath); err != nil {
 		c.Fatal(err)
@@ -1171,7 +1220,7 @@ func (s *DockerDaemonSuite) TestDaemonLoggingDriverDefaultOverride(c *check.C) {
 	id, err := s.d.getIDByName("test")
 	c.Assert(err, check.IsNil)
 
-	logPath := filepath.Join(s.d.root, "containers", id, id+"-json.log")
+	logPath := filepath.Join(s.d.rootDir(), "containers", id, id+"-json.log")
 
 	if _, err := os.Stat(logPath); err == nil || !os.IsNotExist(err) {
 		c.Fatalf("%s shouldn't exits, error on Stat: %s", logPath, err)
@@ -1209,7 +1258,7 @@ func (s *DockerDaemonSuite) TestDaemonLoggingDriverNoneOverride(c *check.C) {
 	id, err := s.d.getIDByName("test")
 	c.Assert(err, check.IsNil)
 
-	logPath := filepath.Join(s.d.root, "containers", id, id+"-json.log")
+	logPath := filepath.Join(s.d.rootDir(), "containers", id, id+"-json.log")
 
 	if _, err := os.Stat(logPath); err != nil {
 		c.Fatal(err)
@@ -1857,6 +1906,120 @@ func (s *DockerDaemonSuite) TestDaemonStartWithDefalutTlsHost(c *check.C) {
 	}
 }
 
+// tlsFixtures are the files of a CA and of a server and a client
+// certificate signed by it.
+type tlsFixtures struct {
+	ca, serverCert, serverKey, clientCert, clientKey string
+}
+
+// writeTLSFixtures creates a new CA in dir, unrelated to the one in
+// fixtures/https, with a certificate for a server on localhost and one for
+// a client.
+func writeTLSFixtures(c *check.C, dir string) tlsFixtures {
+	writePEM := func(name, blockType string, b []byte) string {
+		p := filepath.Join(dir, name)
+		f, err := os.Create(p)
+		c.Assert(err, checker.IsNil)
+		defer f.Close()
+		c.Assert(pem.Encode(f, &pem.Block{Type: blockType, Bytes: b}), checker.IsNil)
+		return p
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(24 * time.Hour)
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, checker.IsNil)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "integration test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	c.Assert(err, checker.IsNil)
+	caCert, err := x509.ParseCertificate(caDER)
+	c.Assert(err, checker.IsNil)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		c.Assert(err, checker.IsNil)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		c.Assert(err, checker.IsNil)
+		return writePEM(name+"-cert.pem", "CERTIFICATE", der), writePEM(name+"-key.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	}
+
+	f := tlsFixtures{ca: writePEM("ca.pem", "CERTIFICATE", caDER)}
+	f.serverCert, f.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	f.clientCert, f.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return f
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartWithCustomClientTLSOptions(c *check.C) {
+	dir, err := ioutil.TempDir("", "tls-fixtures")
+	c.Assert(err, checker.IsNil)
+	defer os.RemoveAll(dir)
+	fixtures := writeTLSFixtures(c, dir)
+
+	// the daemon only trusts the new CA, so the readiness ping only
+	// succeeds with the client certificate of TLSOptions
+	s.d.useDefaultTLSHost = true
+	s.d.TLSOptions = &tlsconfig.Options{
+		CAFile:   fixtures.ca,
+		CertFile: fixtures.clientCert,
+		KeyFile:  fixtures.clientKey,
+	}
+	defer func() {
+		s.d.useDefaultTLSHost = false
+		s.d.TLSOptions = nil
+	}()
+	c.Assert(s.d.Start(
+		"--tlsverify",
+		"--tlscacert", fixtures.ca,
+		"--tlscert", fixtures.serverCert,
+		"--tlskey", fixtures.serverKey), check.IsNil)
+	_, err = s.d.Info()
+	c.Assert(err, checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartWithRogueClientTLSOptions(c *check.C) {
+	s.d.useDefaultTLSHost = true
+	s.d.TLSOptions = &tlsconfig.Options{
+		CAFile:   "fixtures/https/ca.pem",
+		CertFile: "fixtures/https/client-rogue-cert.pem",
+		KeyFile:  "fixtures/https/client-rogue-key.pem",
+	}
+	defer func() {
+		s.d.useDefaultTLSHost = false
+		s.d.TLSOptions = nil
+	}()
+	// the daemon does not trust the rogue client certificate, so it never
+	// answers the readiness ping
+	c.Assert(s.d.Start(
+		"--tlsverify",
+		"--tlscacert", "fixtures/https/ca.pem",
+		"--tlscert", "fixtures/https/server-cert.pem",
+		"--tlskey", "fixtures/https/server-key.pem"), check.NotNil)
+
+	// the daemon itself did start, and has to be stopped
+	c.Assert(s.d.cmd, checker.NotNil)
+	pid := s.d.cmd.Process.Pid
+	c.Assert(s.d.Stop(), checker.IsNil)
+	c.Assert(syscall.Kill(pid, 0), checker.Equals, syscall.ESRCH)
+}
+
 func (s *DockerDaemonSuite) TestBridgeIPIsExcludedFromAllocatorPool(c *check.C) {
 	defaultNetworkBridge := "docker0"
 	deleteInterface(c, defaultNetworkBridge)
@@ -2368,3 +2531,2451 @@ func (s *DockerDaemonSuite) TestDaemonDnsOptionsInHostMode(c *check.C) {
 	out, _ := s.d.Cmd("run", "--net=host", "busybox", "cat", "/etc/resolv.conf")
 	c.Assert(out, checker.Contains, expectedOutput, check.Commentf("Expected '%s', but got %q", expectedOutput, out))
 }
+
+func (s *DockerDaemonSuite) TestDaemonTCPHostConcurrentStart(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+
+	d1 := s.d
+	d2 := NewDaemon(c)
+	d1.UseTCP("127.0.0.1")
+	d2.UseTCP("127.0.0.1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, d := range []*Daemon{d1, d2} {
+		wg.Add(1)
+		go func(d *Daemon) {
+			defer wg.Done()
+			errs <- d.Start()
+		}(d)
+	}
+	wg.Wait()
+	close(errs)
+	defer d2.Stop()
+
+	for err := range errs {
+		c.Assert(err, checker.IsNil)
+	}
+	c.Assert(d1.sock(), checker.Not(checker.Equals), d2.sock())
+
+	for _, d := range []*Daemon{d1, d2} {
+		out, err := d.Cmd("info")
+		c.Assert(err, checker.IsNil, check.Commentf(out))
+	}
+}
+
+func (s *DockerDaemonSuite) TestDaemonVersion(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+
+	v, err := s.d.Version()
+	c.Assert(err, checker.IsNil)
+	c.Assert(v.APIVersion, checker.Not(checker.Equals), "")
+	c.Assert(v.Os, checker.Equals, daemonPlatform)
+}
+
+func (s *DockerDaemonSuite) TestDaemonNoLeakedMountsAfterStop(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	c.Assert(s.d.Stop(), checker.IsNil)
+	c.Assert(s.d.AssertNoLeakedMounts(), checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonLeakedContainers(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	c.Assert(s.d.AssertNoLeakedContainers(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "--name", "leaked", "-v", "/data", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	c.Assert(s.d.AssertNoLeakedContainers(), checker.NotNil)
+	c.Assert(s.d.AssertNoLeakedContainers("leaked"), checker.IsNil)
+
+	c.Assert(s.d.RemoveAllContainers(true), checker.IsNil)
+	c.Assert(s.d.AssertNoLeakedContainers(), checker.IsNil)
+	// the anonymous volume of the container is left alone
+	out, err = s.d.Cmd("volume", "ls", "-q")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(strings.TrimSpace(out), checker.Not(checker.Equals), "")
+}
+
+func (s *DockerDaemonSuite) TestDaemonStopKillsAfterTimeout(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+	pid := s.d.cmd.Process.Pid
+	// a stopped daemon does not handle the interrupt, only SIGKILL ends it
+	c.Assert(syscall.Kill(pid, syscall.SIGSTOP), checker.IsNil)
+	s.d.StopTimeout = 2 * time.Second
+
+	err := s.d.Stop()
+	c.Assert(err, checker.NotNil)
+	exitErr, ok := err.(*exec.ExitError)
+	c.Assert(ok, checker.True, check.Commentf("unexpected error: %v", err))
+	status := exitErr.Sys().(syscall.WaitStatus)
+	c.Assert(status.Signaled(), checker.True, check.Commentf("daemon exited with %v", status))
+	c.Assert(status.Signal(), checker.Equals, syscall.SIGKILL)
+
+	_, err = s.d.WaitExit()
+	c.Assert(err, checker.Equals, errDaemonKilled)
+	c.Assert(syscall.Kill(pid, 0), checker.Equals, syscall.ESRCH)
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitExit(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(s.d.Stop(), checker.IsNil)
+
+	code, err := s.d.WaitExit()
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 0)
+
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(s.d.Kill(), checker.IsNil)
+
+	_, err = s.d.WaitExit()
+	c.Assert(err, checker.Equals, errDaemonKilled)
+}
+
+func (s *DockerDaemonSuite) TestDaemonKillWithoutPidfile(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(os.Remove(filepath.Join(s.d.folder, "docker.pid")), checker.IsNil)
+	c.Assert(s.d.Kill(), checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonCleanup(c *check.C) {
+	d := NewDaemon(c)
+	// never started
+	c.Assert(d.Cleanup(), checker.IsNil)
+	_, err := os.Stat(d.folder)
+	c.Assert(os.IsNotExist(err), checker.True, check.Commentf("%s still exists: %v", d.folder, err))
+
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(s.d.Cleanup(), checker.IsNil)
+	_, err = os.Stat(s.d.folder)
+	c.Assert(os.IsNotExist(err), checker.True, check.Commentf("%s still exists: %v", s.d.folder, err))
+}
+
+// keepFolderSuite is run on its own by TestDaemonCleanupKeepsFolderOnFailure,
+// Cleanup can only be observed keeping the directory from a failed test.
+type keepFolderSuite struct {
+	fail   bool
+	folder string
+}
+
+func (s *keepFolderSuite) TestCleanup(c *check.C) {
+	d := NewDaemon(c)
+	d.KeepFolderOnFailure = true
+	s.folder = d.folder
+	if s.fail {
+		c.Fail()
+	}
+	d.Cleanup()
+}
+
+func (s *DockerDaemonSuite) TestDaemonCleanupKeepsFolderOnFailure(c *check.C) {
+	passing := &keepFolderSuite{}
+	result := check.Run(passing, &check.RunConf{Output: ioutil.Discard})
+	c.Assert(result.Succeeded, checker.Equals, 1)
+	_, err := os.Stat(passing.folder)
+	c.Assert(os.IsNotExist(err), checker.True, check.Commentf("%s still exists: %v", passing.folder, err))
+
+	failing := &keepFolderSuite{fail: true}
+	result = check.Run(failing, &check.RunConf{Output: ioutil.Discard})
+	c.Assert(result.Failed, checker.Equals, 1)
+	defer os.RemoveAll(failing.folder)
+	_, err = os.Stat(failing.folder)
+	c.Assert(err, checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonRemoveOrphanedDaemonFolders(c *check.C) {
+	dest, err := ioutil.TempDir("", "daemon-folders")
+	c.Assert(err, checker.IsNil)
+	defer os.RemoveAll(dest)
+
+	old := time.Now().Add(-2 * orphanedDaemonFolderAge)
+	for _, name := range []string{"d1", "d2", "other"} {
+		c.Assert(os.Mkdir(filepath.Join(dest, name), 0755), checker.IsNil)
+	}
+	// d2 is still in use, other was not created by NewDaemon
+	for _, name := range []string{"d1", "other"} {
+		c.Assert(os.Chtimes(filepath.Join(dest, name), old, old), checker.IsNil)
+	}
+
+	c.Assert(removeOrphanedDaemonFolders(dest, orphanedDaemonFolderAge), checker.IsNil)
+	fis, err := ioutil.ReadDir(dest)
+	c.Assert(err, checker.IsNil)
+	var left []string
+	for _, fi := range fis {
+		left = append(left, fi.Name())
+	}
+	c.Assert(left, checker.DeepEquals, []string{"d2", "other"})
+}
+
+func (s *DockerDaemonSuite) TestDaemonCmdRetry(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "sh", "-c", "sleep 1; touch /ready; top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+
+	// fails until the container has created the file
+	out, err = s.d.CmdRetry(10, 100*time.Millisecond, "exec", id, "test", "-f", "/ready")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	start := time.Now()
+	_, err = s.d.CmdRetry(3, 5*time.Second, "inspect", "doesnotexist")
+	c.Assert(err, checker.NotNil)
+	c.Assert(time.Since(start) < 5*time.Second, checker.True, check.Commentf("permanent failure was retried"))
+
+	// no attempt at all is an error rather than a silent success
+	_, err = s.d.CmdRetry(0, time.Second, "ps")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "invalid number of attempts")
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartWithImagesReportsMissingImage(c *check.C) {
+	err := s.d.StartWithImages([]string{"busybox:latest", "doesnotexist:latest"})
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "doesnotexist:latest")
+	c.Assert(err.Error(), checker.Not(checker.Contains), "busybox:latest")
+
+	out, err := s.d.Cmd("inspect", "busybox:latest")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+}
+
+func (s *DockerDaemonSuite) TestDaemonSaveImageToOtherDaemon(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	d2 := NewDaemon(c)
+	c.Assert(d2.Start(), checker.IsNil)
+	defer d2.Stop()
+
+	out, err := s.d.Cmd("tag", "busybox", "transfer:latest")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	expected, err := s.d.getIDByName("transfer:latest")
+	c.Assert(err, checker.IsNil)
+
+	tar := filepath.Join(s.d.folder, "transfer.tar")
+	c.Assert(s.d.SaveImage("transfer:latest", tar), checker.IsNil)
+	c.Assert(d2.LoadImageFromFile(tar), checker.IsNil)
+
+	id, err := d2.getIDByName("transfer:latest")
+	c.Assert(err, checker.IsNil)
+	c.Assert(id, checker.Equals, expected)
+
+	err = s.d.SaveImage("doesnotexist:latest", tar)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "doesnotexist:latest")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCopyToFromContainer(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+
+	tmp, err := ioutil.TempDir("", "daemon-cp")
+	c.Assert(err, checker.IsNil)
+	defer os.RemoveAll(tmp)
+
+	// single file
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "file"), []byte("hello"), 0644), checker.IsNil)
+	c.Assert(s.d.CopyToContainer(id, filepath.Join(tmp, "file"), "/file"), checker.IsNil)
+	out, err = s.d.Cmd("exec", id, "cat", "/file")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(out, checker.Equals, "hello")
+
+	out, err = s.d.Cmd("exec", id, "sh", "-c", "echo -n world > /file")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(s.d.CopyFromContainer(id, "/file", filepath.Join(tmp, "out")), checker.IsNil)
+	b, err := ioutil.ReadFile(filepath.Join(tmp, "out"))
+	c.Assert(err, checker.IsNil)
+	c.Assert(string(b), checker.Equals, "world")
+
+	// directory, from a stopped container
+	c.Assert(os.Mkdir(filepath.Join(tmp, "dir"), 0755), checker.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp, "dir", "nested"), []byte("nested"), 0644), checker.IsNil)
+	c.Assert(s.d.CopyToContainer(id, filepath.Join(tmp, "dir"), "/dir"), checker.IsNil)
+	out, err = s.d.Cmd("stop", id)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(s.d.CopyFromContainer(id, "/dir", filepath.Join(tmp, "dirout")), checker.IsNil)
+	b, err = ioutil.ReadFile(filepath.Join(tmp, "dirout", "nested"))
+	c.Assert(err, checker.IsNil)
+	c.Assert(string(b), checker.Equals, "nested")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCgroupDriver(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	drivers := []string{"cgroupfs"}
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		drivers = append(drivers, "systemd")
+	}
+
+	for _, driver := range drivers {
+		s.d.CgroupDriver = driver
+		c.Assert(s.d.Start(), checker.IsNil)
+		c.Assert(s.d.CheckCgroupDriver(), checker.IsNil)
+		c.Assert(s.d.Stop(), checker.IsNil)
+	}
+}
+
+func (s *DockerDaemonSuite) TestDaemonForEachStorageDriver(c *check.C) {
+	testRequires(c, SameHostDaemon)
+
+	var tested []string
+	ForEachStorageDriver(c, []string{"vfs", "overlay"}, func(d *Daemon) {
+		info, err := d.Info()
+		c.Assert(err, checker.IsNil)
+		out, err := d.Cmd("run", "--rm", "busybox", "true")
+		c.Assert(err, checker.IsNil, check.Commentf(out))
+		tested = append(tested, info.Driver)
+	})
+	// vfs is supported everywhere
+	c.Assert(tested, checker.Not(checker.HasLen), 0)
+	c.Assert(tested[0], checker.Equals, "vfs")
+}
+
+func (s *DockerDaemonSuite) TestDaemonRestartKeepsRoot(c *check.C) {
+	testRequires(c, SameHostDaemon, UserNamespaceInKernel, NotUserNamespace)
+	s.d.UsernsRemap = "default"
+	c.Assert(s.d.Start(), checker.IsNil)
+	root := s.d.rootDir()
+	c.Assert(filepath.Base(root), checker.Matches, `^\d+\.\d+$`)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(s.d.Restart(), checker.IsNil)
+		c.Assert(s.d.rootDir(), checker.Equals, root)
+	}
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartDaemonsInParallel(c *check.C) {
+	daemons := []*Daemon{NewDaemon(c), NewDaemon(c), NewDaemon(c)}
+	var (
+		mu      sync.Mutex
+		waiting = map[*Daemon]struct{}{}
+	)
+	// none of the daemons gets ready before all of them answered /_ping,
+	// which cannot happen if they are started one after the other
+	for _, d := range daemons {
+		d.ReadyFunc = func(d *Daemon) error {
+			mu.Lock()
+			defer mu.Unlock()
+			waiting[d] = struct{}{}
+			if len(waiting) < len(daemons) {
+				return fmt.Errorf("%d of %d daemons are up", len(waiting), len(daemons))
+			}
+			return nil
+		}
+	}
+	err := StartDaemons(daemons)
+	for _, d := range daemons {
+		defer d.Stop()
+	}
+	c.Assert(err, checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonPool(c *check.C) {
+	pool := NewDaemonPool(c)
+	folders := map[string]struct{}{}
+	for i := 0; i < 3; i++ {
+		d1 := pool.Acquire()
+		d2 := pool.Acquire()
+		c.Assert(d1.Start(), checker.IsNil)
+		folders[d1.folder] = struct{}{}
+		folders[d2.folder] = struct{}{}
+		pool.Release(d1)
+		pool.Release(d2)
+	}
+	// released daemons are reused
+	c.Assert(folders, checker.HasLen, 2)
+
+	c.Assert(pool.CleanupAll(), checker.IsNil)
+	for folder := range folders {
+		_, err := os.Stat(folder)
+		c.Assert(os.IsNotExist(err), checker.True, check.Commentf("%s still exists: %v", folder, err))
+	}
+}
+
+func (s *DockerDaemonSuite) TestDaemonTCPHostBadFlagNotRetried(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	s.d.UseTCP("127.0.0.1")
+	err := s.d.Start("--no-such-flag")
+	c.Assert(err, checker.FitsTypeOf, daemonExitedError{})
+	c.Assert(c.GetTestLog(), checker.Not(checker.Contains), "retrying with another port")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCmdDuringRestart(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	// the TCP port, and so the address Cmd uses, changes on restart
+	s.d.UseTCP("127.0.0.1")
+	c.Assert(s.d.Start(), checker.IsNil)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					// failures are expected while the daemon is down
+					s.d.Cmd("version")
+				}
+			}
+		}()
+	}
+
+	err := s.d.Restart()
+	close(stop)
+	wg.Wait()
+	c.Assert(err, checker.IsNil)
+
+	out, err := s.d.Cmd("version")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+}
+
+func (s *DockerDaemonSuite) TestDaemonStopDaemons(c *check.C) {
+	d1, d2, d3 := s.d, NewDaemon(c), NewDaemon(c)
+	c.Assert(StartDaemons([]*Daemon{d1, d3}), checker.IsNil)
+
+	// d2 was never started
+	errs := StopDaemons(d1, d2, d3)
+	c.Assert(errs, checker.HasLen, 1)
+	c.Assert(errs[0].Error(), checker.Contains, d2.id)
+
+	// everything is stopped now
+	c.Assert(StopDaemons(d1, d2, d3), checker.HasLen, 3)
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitRun(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	start := time.Now()
+	c.Assert(s.d.WaitRun(strings.TrimSpace(out), 30*time.Second), checker.IsNil)
+	c.Assert(time.Since(start) < 5*time.Second, checker.True)
+
+	out, err = s.d.Cmd("create", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	err = s.d.WaitRun(strings.TrimSpace(out), time.Second)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "false")
+}
+
+func (s *DockerDaemonSuite) TestDaemonExtraHosts(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	s.d.ExtraHosts = []string{"foo://bar"}
+	c.Assert(s.d.Start(), checker.NotNil)
+
+	addr, err := freeTCPAddr("127.0.0.1")
+	c.Assert(err, checker.IsNil)
+	s.d.ExtraHosts = []string{"tcp://" + addr}
+	c.Assert(s.d.Start(), checker.IsNil)
+
+	status, _, err := s.d.SockRequest("GET", "/_ping", nil)
+	c.Assert(err, checker.IsNil)
+	c.Assert(status, checker.Equals, http.StatusOK)
+
+	resp, err := http.Get("http://" + addr + "/_ping")
+	c.Assert(err, checker.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, checker.Equals, http.StatusOK)
+}
+
+func (s *DockerDaemonSuite) TestNewDaemonWithoutDest(c *check.C) {
+	dest := os.Getenv("DEST")
+	defer os.Setenv("DEST", dest)
+	os.Unsetenv("DEST")
+
+	d := NewDaemon(c)
+	defer d.Cleanup()
+	c.Assert(strings.HasPrefix(d.folder, os.TempDir()), checker.True, check.Commentf("unexpected folder %s", d.folder))
+	_, err := os.Stat(d.rootDir())
+	c.Assert(err, checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonRestartWithLogFile(c *check.C) {
+	out, err := ioutil.TempFile("", "shared-log")
+	c.Assert(err, checker.IsNil)
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	c.Assert(s.d.StartWithLogFile(out), checker.IsNil)
+	c.Assert(s.d.RestartWithLogFile(out), checker.IsNil)
+
+	// a daemon that has to be killed reports the end of the caller's log
+	const marker = "last line of the shared log"
+	_, err = out.WriteString(marker + "\n")
+	c.Assert(err, checker.IsNil)
+	c.Assert(syscall.Kill(s.d.cmd.Process.Pid, syscall.SIGSTOP), checker.IsNil)
+	s.d.StopTimeout = 2 * time.Second
+	c.Assert(s.d.RestartWithLogFile(out), checker.IsNil)
+	testLog := c.GetTestLog()
+	i := strings.Index(testLog, "did not stop within")
+	c.Assert(i, checker.Not(checker.Equals), -1, check.Commentf(testLog))
+	c.Assert(testLog[i:], checker.Contains, marker)
+	c.Assert(s.d.Stop(), checker.IsNil)
+
+	b, err := ioutil.ReadFile(out.Name())
+	c.Assert(err, checker.IsNil)
+	c.Assert(strings.Count(string(b), "Daemon has completed initialization"), checker.Equals, 3, check.Commentf("%s", b))
+}
+
+func (s *DockerDaemonSuite) TestDaemonInspectJSON(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "--name", "inspectjson", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	var ctr types.ContainerJSON
+	c.Assert(s.d.InspectJSON("inspectjson", &ctr), checker.IsNil)
+	c.Assert(ctr.ID, checker.Equals, strings.TrimSpace(out))
+	c.Assert(ctr.State.Running, checker.True)
+
+	out, err = s.d.Cmd("network", "create", "inspectjsonnet")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	var nw types.NetworkResource
+	c.Assert(s.d.InspectJSON("inspectjsonnet", &nw), checker.IsNil)
+	c.Assert(nw.Name, checker.Equals, "inspectjsonnet")
+	c.Assert(nw.Driver, checker.Equals, "bridge")
+
+	var m map[string]interface{}
+	c.Assert(s.d.InspectJSON("busybox", &m), checker.IsNil)
+	c.Assert(m["Id"], checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonPanicDetection(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+	panicked, _ := s.d.HasPanicked()
+	c.Assert(panicked, checker.False)
+
+	// pretend the daemon crashed
+	f, err := os.OpenFile(s.d.LogFileName(), os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, checker.IsNil)
+	_, err = f.WriteString("panic: something went wrong\n\ngoroutine 1 [running]:\n")
+	f.Close()
+	c.Assert(err, checker.IsNil)
+
+	var msg string
+	for i := 0; i < 50 && !panicked; i++ {
+		time.Sleep(100 * time.Millisecond)
+		panicked, msg = s.d.HasPanicked()
+	}
+	c.Assert(panicked, checker.True)
+	c.Assert(msg, checker.Contains, "something went wrong")
+
+	_, err = s.d.Cmd("inspect", "doesnotexist")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "daemon panicked")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCmdWithStdin(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	dockerfile := "FROM busybox\nLABEL from=stdin\n"
+	out, err := s.d.CmdWithStdin(strings.NewReader(dockerfile), "build", "-t", "fromstdin", "-")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	label, err := s.d.inspectFilter("fromstdin", `index .Config.Labels "from"`)
+	c.Assert(err, checker.IsNil)
+	c.Assert(label, checker.Equals, "stdin")
+}
+
+func (s *DockerDaemonSuite) TestDaemonTailLog(c *check.C) {
+	var content string
+	for i := 0; i < 2000; i++ {
+		content += fmt.Sprintf("line %d\n", i)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(s.d.folder, "docker.log"), []byte(content), 0600), checker.IsNil)
+
+	lines, err := s.d.TailLog(3)
+	c.Assert(err, checker.IsNil)
+	c.Assert(lines, checker.DeepEquals, []string{"line 1997", "line 1998", "line 1999"})
+
+	lines, err = s.d.TailLog(5000)
+	c.Assert(err, checker.IsNil)
+	c.Assert(lines, checker.HasLen, 2000)
+	c.Assert(lines[0], checker.Equals, "line 0")
+}
+
+func (s *DockerDaemonSuite) TestDaemonLogEntries(c *check.C) {
+	// the daemon has no JSON log formatter flag, so write logrus JSON output directly
+	content := `API listen on /var/run/docker.sock
+{"level":"info","msg":"Loading containers: start.","time":"2016-06-01T10:00:00Z"}
+{"level":"error","msg":"'overlay2' not found as a supported filesystem on this host","storage-driver":"overlay2","time":"2016-06-01T10:00:01Z"}
+{"level":"error","msg":"Handler for GET /containers/json returned error","time":"2016-06-01T10:00:02Z"}
+{"level":"info","msg":"truncated
+`
+	c.Assert(ioutil.WriteFile(filepath.Join(s.d.folder, "docker.log"), []byte(content), 0600), checker.IsNil)
+
+	entries, err := s.d.LogEntries()
+	c.Assert(err, checker.IsNil)
+	c.Assert(entries, checker.HasLen, 3)
+
+	entries, err = s.d.LogEntriesWhere("error", "overlay2")
+	c.Assert(err, checker.IsNil)
+	c.Assert(entries, checker.HasLen, 1)
+	c.Assert(entries[0]["storage-driver"], checker.Equals, "overlay2")
+}
+
+func (s *DockerDaemonSuite) TestDaemonLogEntriesLiveDaemon(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+	out, err := s.d.Cmd("inspect", "doesnotexist")
+	c.Assert(err, checker.NotNil, check.Commentf(out))
+
+	// the daemon only has a text formatter, none of its lines are entries
+	lines, err := s.d.TailLog(1000)
+	c.Assert(err, checker.IsNil)
+	c.Assert(lines, checker.Not(checker.HasLen), 0)
+	entries, err := s.d.LogEntries()
+	c.Assert(err, checker.IsNil)
+	c.Assert(entries, checker.HasLen, 0)
+
+	// JSON lines written by anything sharing the log are found between the
+	// lines the running daemon keeps writing
+	f, err := os.OpenFile(s.d.logPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, checker.IsNil)
+	_, err = f.WriteString(`{"level":"error","msg":"could not find doesnotexist","time":"2016-06-01T10:00:00Z"}` + "\n")
+	f.Close()
+	c.Assert(err, checker.IsNil)
+	out, err = s.d.Cmd("inspect", "doesnotexist")
+	c.Assert(err, checker.NotNil, check.Commentf(out))
+
+	entries, err = s.d.LogEntriesWhere("error", "doesnotexist")
+	c.Assert(err, checker.IsNil)
+	c.Assert(entries, checker.HasLen, 1)
+	entries, err = s.d.LogEntriesWhere("info", "")
+	c.Assert(err, checker.IsNil)
+	c.Assert(entries, checker.HasLen, 0)
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitForContainerExit(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "sh", "-c", "sleep 1; exit 42")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	code, err := s.d.WaitForContainerExit(id, 30*time.Second)
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 42)
+
+	out, err = s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	_, err = s.d.WaitForContainerExit(strings.TrimSpace(out), time.Second)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "still running")
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartReadyFunc(c *check.C) {
+	calls := 0
+	s.d.ReadyFunc = func(d *Daemon) error {
+		calls++
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if calls < 3 {
+			return fmt.Errorf("%d containers, waiting", info.Containers)
+		}
+		return nil
+	}
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(calls, checker.Equals, 3)
+	c.Assert(s.d.Stop(), checker.IsNil)
+
+	s.d.ReadyFunc = func(d *Daemon) error {
+		return fmt.Errorf("never ready")
+	}
+	err := s.d.Start()
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "never ready")
+}
+
+func (s *DockerDaemonSuite) TestDaemonPingWaitsForOK(c *check.C) {
+	var (
+		mu    sync.Mutex
+		pings int
+		conns int
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pings++
+		n := pings
+		mu.Unlock()
+		if n < 3 {
+			http.Error(w, "graph driver still initializing", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	config := &clientConfig{
+		transport: &http.Transport{},
+		scheme:    "http",
+		addr:      strings.TrimPrefix(server.URL, "http://"),
+	}
+	for i := 0; i < 2; i++ {
+		err := config.ping()
+		c.Assert(err, checker.FitsTypeOf, pingStatusError{})
+	}
+	c.Assert(config.ping(), checker.IsNil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(pings, checker.Equals, 3)
+	// closed bodies let every poll reuse the same connection
+	c.Assert(conns, checker.Equals, 1)
+}
+
+func (s *DockerDaemonSuite) TestDaemonRequestsDoNotLeakConnections(c *check.C) {
+	var (
+		mu     sync.Mutex
+		opened int
+		open   int
+	)
+	closed := make(chan struct{}, 20)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			opened++
+			open++
+		case http.StateClosed:
+			open--
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	// requests go to the test server instead of a started daemon
+	s.d.tcpAddr = strings.TrimPrefix(server.URL, "http://")
+	for i := 0; i < 20; i++ {
+		_, err := s.d.Info()
+		c.Assert(err, checker.IsNil)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			c.Fatalf("only %d of the connections were closed", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(opened, checker.Equals, 20)
+	c.Assert(open, checker.Equals, 0)
+}
+
+func (s *DockerDaemonSuite) TestDaemonAPICall(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+
+	resp, err := s.d.APICall("GET", "/version", nil)
+	c.Assert(err, checker.IsNil)
+	b, err := readBody(resp.Body)
+	c.Assert(err, checker.IsNil)
+	c.Assert(resp.StatusCode, checker.Equals, http.StatusOK)
+	c.Assert(string(b), checker.Contains, `"ApiVersion"`)
+
+	var v types.Version
+	c.Assert(s.d.APICallJSON("GET", "/version", nil, &v), checker.IsNil)
+	c.Assert(v.APIVersion, checker.Not(checker.Equals), "")
+
+	err = s.d.APICallJSON("GET", "/containers/doesnotexist/json", nil, nil)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "404")
+}
+
+func (s *DockerDaemonSuite) TestDaemonAPIVersion(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "-v", "/foo", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	var current map[string]interface{}
+	c.Assert(s.d.APICallJSON("GET", "/containers/"+id+"/json", nil, &current), checker.IsNil)
+	c.Assert(current["Mounts"], checker.NotNil)
+	c.Assert(current["VolumesRW"], checker.IsNil)
+
+	// clients older than 1.20 get volumes in the pre-Mounts format
+	s.d.APIVersion = "1.19"
+	var old map[string]interface{}
+	c.Assert(s.d.APICallJSON("GET", "/containers/"+id+"/json", nil, &old), checker.IsNil)
+	c.Assert(old["VolumesRW"], checker.NotNil)
+	c.Assert(old["Mounts"], checker.IsNil)
+
+	out, err = s.d.Cmd("version", "--format", "{{.Client.APIVersion}}")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "1.19")
+
+	s.d.APIVersion = "v1.19"
+	_, err = s.d.APICall("GET", "/version", nil)
+	c.Assert(err, checker.NotNil)
+	_, err = s.d.Cmd("version")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonServerTime(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	since, err := s.d.ServerTime()
+	c.Assert(err, checker.IsNil)
+	out, err := s.d.Cmd("create", "--name", "timed", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	until, err := s.d.ServerTime()
+	c.Assert(err, checker.IsNil)
+	c.Assert(until.After(since), checker.True)
+
+	out, err = s.d.Cmd("events", "--since", parseEventTime(since), "--until", parseEventTime(until), "--filter", "event=create")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(out, checker.Contains, "name=timed")
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartupDuration(c *check.C) {
+	c.Assert(s.d.StartupDuration(), checker.Equals, time.Duration(0))
+
+	start := time.Now()
+	c.Assert(s.d.Start(), checker.IsNil)
+	elapsed := time.Since(start)
+
+	c.Assert(s.d.StartupDuration() > 0, checker.True)
+	c.Assert(s.d.StartupDuration() <= elapsed, checker.True, check.Commentf("startup %v, wall time %v", s.d.StartupDuration(), elapsed))
+}
+
+func (s *DockerDaemonSuite) TestDaemonCleanExit(c *check.C) {
+	c.Assert(s.d.CleanExit(), checker.NotNil)
+
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(s.d.Stop(), checker.IsNil)
+	s.d.AssertCleanExit(c)
+
+	// a forced shutdown of an earlier run does not taint the next one
+	f, err := os.OpenFile(s.d.logPath(), os.O_APPEND|os.O_WRONLY, 0)
+	c.Assert(err, checker.IsNil)
+	_, err = f.WriteString(forcedShutdownLog + "\n")
+	f.Close()
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.CleanExit(), checker.NotNil)
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(s.d.Stop(), checker.IsNil)
+	s.d.AssertCleanExit(c)
+
+	// a stopped process cannot handle the interrupt, so Stop has to kill it
+	c.Assert(s.d.Start(), checker.IsNil)
+	c.Assert(s.d.cmd.Process.Signal(syscall.SIGSTOP), checker.IsNil)
+	s.d.StopTimeout = time.Second
+	c.Assert(s.d.Stop(), checker.NotNil)
+	err = s.d.CleanExit()
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "killed")
+}
+
+func (s *DockerDaemonSuite) TestDaemonLogDriverOverride(c *check.C) {
+	s.d.LogDriver = "journald"
+	s.d.LogOpts = map[string]string{"tag": "{{.Name}}"}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("create", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	driver, err := s.d.ContainerLogDriver(strings.TrimSpace(out))
+	c.Assert(err, checker.IsNil)
+	c.Assert(driver, checker.Equals, "journald")
+
+	out, err = s.d.Cmd("create", "--log-driver=json-file", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	driver, err = s.d.ContainerLogDriver(strings.TrimSpace(out))
+	c.Assert(err, checker.IsNil)
+	c.Assert(driver, checker.Equals, "json-file")
+}
+
+func (s *DockerDaemonSuite) TestDaemonStorageOptsDriverStatus(c *check.C) {
+	testRequires(c, Devicemapper)
+	s.d.StorageOpts = []string{"dm.basesize=20G"}
+	c.Assert(s.d.Start(), checker.IsNil)
+
+	status, err := s.d.DriverStatus()
+	c.Assert(err, checker.IsNil)
+	c.Assert(status, checker.Not(checker.HasLen), 0)
+
+	basesize, err := s.d.driverStatusValue("Base Device Size")
+	c.Assert(err, checker.IsNil)
+	c.Assert(basesize, checker.Equals, units.HumanSize(float64(20*1024*1024*1024)))
+
+	_, err = s.d.driverStatusValue("No Such Key")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitForContainerIP(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	ip, err := s.d.WaitForContainerIP(id, "bridge", 10*time.Second)
+	c.Assert(err, checker.IsNil)
+	c.Assert(net.ParseIP(ip), checker.NotNil, check.Commentf("%q is not an IP", ip))
+
+	_, err = s.d.WaitForContainerIP(id, "none", time.Second)
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonRunContainer(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	// an open stdin keeps the busybox shell running
+	id, err := s.d.RunContainer("busybox", "-i", "--name", "detached")
+	c.Assert(err, checker.IsNil)
+	c.Assert(id, checker.Not(checker.Contains), "\n")
+	c.Assert(s.d.waitRun(id), checker.IsNil)
+
+	_, err = s.d.RunContainer("busybox", "--name", "detached")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonRunContainerAndWait(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, code, err := s.d.RunContainerAndWait("busybox", "--entrypoint", "hostname", "--hostname", "foreground")
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 0)
+	c.Assert(strings.TrimSpace(out), checker.Equals, "foreground")
+
+	_, code, err = s.d.RunContainerAndWait("busybox", "--entrypoint", "false")
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 1)
+
+	_, _, err = s.d.RunContainerAndWait("doesnotexist:latest")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonAddCleanup(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	var order []string
+	for _, args := range [][]string{
+		{"volume", "create", "--name", "cleanupvol"},
+		{"network", "create", "cleanupnet"},
+		{"create", "--name", "cleanupctr", "-v", "cleanupvol:/data", "--net", "cleanupnet", "busybox"},
+	} {
+		out, err := s.d.Cmd(args[0], args[1:]...)
+		c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	}
+	// containers have to go before the volume and network they use
+	for _, args := range [][]string{
+		{"volume", "rm", "cleanupvol"},
+		{"network", "rm", "cleanupnet"},
+		{"rm", "cleanupctr"},
+	} {
+		args := args
+		s.d.AddCleanup(func() error {
+			order = append(order, args[len(args)-1])
+			if out, err := s.d.Cmd(args[0], args[1:]...); err != nil {
+				return fmt.Errorf("%v: %s", err, out)
+			}
+			return nil
+		})
+	}
+
+	c.Assert(s.d.Restart(), checker.IsNil)
+	c.Assert(order, checker.DeepEquals, []string{"cleanupctr", "cleanupnet", "cleanupvol"})
+	for _, args := range [][]string{
+		{"inspect", "cleanupctr"},
+		{"network", "inspect", "cleanupnet"},
+		{"volume", "inspect", "cleanupvol"},
+	} {
+		_, err := s.d.Cmd(args[0], args[1:]...)
+		c.Assert(err, checker.NotNil, check.Commentf("%v still exists", args))
+	}
+
+	s.d.AddCleanup(func() error { return fmt.Errorf("first") })
+	s.d.AddCleanup(func() error { return fmt.Errorf("second") })
+	err := s.d.Stop()
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "second; first")
+}
+
+func (s *DockerDaemonSuite) TestDaemonRequireSwapLimit(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	warnings, err := s.d.Warnings()
+	c.Assert(err, checker.IsNil)
+	s.d.RequireFeature("swap-limit")
+	c.Assert(strings.Join(warnings, "\n"), checker.Not(checker.Contains), "No swap limit support")
+
+	out, err := s.d.Cmd("run", "-d", "--name", "swap", "-m", "32m", "--memory-swap", "64m", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	swap, err := s.d.inspectFieldWithError("swap", "HostConfig.MemorySwap")
+	c.Assert(err, checker.IsNil)
+	c.Assert(swap, checker.Equals, "67108864")
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerLifecycleHelpers(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.waitRun(id), checker.IsNil)
+
+	c.Assert(s.d.PauseContainer(id), checker.IsNil)
+	paused, err := s.d.inspectFilter(id, ".State.Paused")
+	c.Assert(err, checker.IsNil)
+	c.Assert(paused, checker.Equals, "true")
+	c.Assert(s.d.UnpauseContainer(id), checker.IsNil)
+	paused, err = s.d.inspectFilter(id, ".State.Paused")
+	c.Assert(err, checker.IsNil)
+	c.Assert(paused, checker.Equals, "false")
+
+	// pid 1 ignores signals it has no handler for
+	out, err := s.d.Cmd("run", "-d", "busybox", "sh", "-c", "trap 'exit 42' TERM; while true; do sleep 1; done")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id = strings.TrimSpace(out)
+	c.Assert(s.d.waitRun(id), checker.IsNil)
+	c.Assert(s.d.KillContainer(id, "SIGTERM"), checker.IsNil)
+	code, err := s.d.WaitForContainerExit(id, 10*time.Second)
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 42)
+
+	c.Assert(s.d.KillContainer(id, "SIGTERM"), checker.NotNil)
+
+	id, err = s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.StopContainer(id, 1), checker.IsNil)
+	running, err := s.d.inspectFilter(id, ".State.Running")
+	c.Assert(err, checker.IsNil)
+	c.Assert(running, checker.Equals, "false")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCommitContainer(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "--name", "writer", "busybox", "sh", "-c", "echo committed > /file")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+
+	id, err := s.d.CommitContainer("writer", "committed:latest", "--change", "CMD cat /file", "--message", "add file")
+	c.Assert(err, checker.IsNil)
+	c.Assert(id, checker.HasPrefix, "sha256:")
+
+	image, err := s.d.InspectImage("committed:latest")
+	c.Assert(err, checker.IsNil)
+	c.Assert(image.ID, checker.Equals, id)
+	c.Assert(image.Comment, checker.Equals, "add file")
+
+	out, code, err := s.d.RunContainerAndWait("committed:latest")
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 0)
+	c.Assert(strings.TrimSpace(out), checker.Equals, "committed")
+
+	_, err = s.d.CommitContainer("doesnotexist", "")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonTagAndRemoveImage(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	c.Assert(s.d.TagImage("busybox:latest", "tagged:one"), checker.IsNil)
+	c.Assert(s.d.TagImage("busybox:latest", "tagged:two"), checker.IsNil)
+	image, err := s.d.InspectImage("busybox:latest")
+	c.Assert(err, checker.IsNil)
+
+	// removing a reference by ID needs force while it has several tags
+	_, err = s.d.RemoveImage(image.ID, false)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "must be forced")
+
+	out, err := s.d.RemoveImage("tagged:one", false)
+	c.Assert(err, checker.IsNil)
+	c.Assert(out, checker.Contains, "Untagged: tagged:one")
+	c.Assert(out, checker.Not(checker.Contains), "Deleted:")
+	_, err = s.d.InspectImage(image.ID)
+	c.Assert(err, checker.IsNil)
+
+	c.Assert(s.d.TagImage("tagged:one", "tagged:three"), checker.NotNil)
+
+	_, err = s.d.RemoveImage("busybox:latest", false)
+	c.Assert(err, checker.IsNil)
+	out, err = s.d.RemoveImage("tagged:two", false)
+	c.Assert(err, checker.IsNil)
+	c.Assert(out, checker.Contains, "Deleted: "+image.ID)
+	_, err = s.d.InspectImage(image.ID)
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerTop(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "sleep", "1234")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	top, err := s.d.ContainerTop(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(top.Processes, checker.HasLen, 1)
+	cmdCol := -1
+	for i, t := range top.Titles {
+		if t == "CMD" {
+			cmdCol = i
+		}
+	}
+	c.Assert(cmdCol, checker.Not(checker.Equals), -1, check.Commentf("titles: %v", top.Titles))
+	c.Assert(top.Processes[0][cmdCol], checker.Equals, "sleep 1234")
+
+	top, err = s.d.ContainerTop(id, "-o", "pid,comm")
+	c.Assert(err, checker.IsNil)
+	c.Assert(top.Titles, checker.DeepEquals, []string{"PID", "COMMAND"})
+	c.Assert(top.Processes[0][1], checker.Equals, "sleep")
+}
+
+func (s *DockerDaemonSuite) TestDaemonRenameContainer(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("create", "--name", "first", "busybox")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+	out, err = s.d.Cmd("create", "--name", "taken", "busybox")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+
+	c.Assert(s.d.RenameContainer("first", "renamed"), checker.IsNil)
+	ctr, err := s.d.InspectContainer(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(ctr.Name, checker.Equals, "/renamed")
+
+	err = s.d.RenameContainer("renamed", "taken")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "Conflict. The name \"/taken\" is already in use")
+	ctr, err = s.d.InspectContainer(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(ctr.Name, checker.Equals, "/renamed")
+}
+
+func (s *DockerDaemonSuite) TestDaemonRlimits(c *check.C) {
+	testRequires(c, DaemonIsLinux, SameHostDaemon)
+	var before syscall.Rlimit
+	c.Assert(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &before), checker.IsNil)
+
+	s.d.Rlimits = []Rlimit{{Resource: syscall.RLIMIT_NOFILE, Soft: 1024, Hard: 1024}}
+	// the userland proxy runs as a child process of the daemon
+	s.d.userlandProxy = true
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	id, err := s.d.RunContainer("busybox", "-i", "-p", "80")
+	c.Assert(err, checker.IsNil)
+	_, err = s.d.WaitForPort(id, "80/tcp", 30*time.Second)
+	c.Assert(err, checker.IsNil)
+
+	pid := s.d.cmd.Process.Pid
+	proxies := childProcesses(c, pid, "docker-proxy")
+	c.Assert(proxies, checker.Not(checker.HasLen), 0)
+	for _, p := range append(proxies, pid) {
+		limits, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", p))
+		c.Assert(err, checker.IsNil)
+		c.Assert(string(limits), checker.Matches, `(?s).*Max open files\s+1024\s+1024\s.*`)
+	}
+
+	var after syscall.Rlimit
+	c.Assert(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &after), checker.IsNil)
+	c.Assert(after, checker.DeepEquals, before)
+}
+
+// childProcesses returns the IDs of the child processes of pid with the
+// given command name.
+func childProcesses(c *check.C, pid int, name string) []int {
+	dirs, err := ioutil.ReadDir("/proc")
+	c.Assert(err, checker.IsNil)
+	var children []int
+	for _, dir := range dirs {
+		child, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "stat"))
+		if err != nil {
+			// exited meanwhile
+			continue
+		}
+		// the command name is in parentheses and may contain spaces, the
+		// state and the parent process ID follow it
+		i := strings.LastIndex(string(stat), ")")
+		fields := strings.Fields(string(stat)[i+1:])
+		comm := string(stat)[strings.Index(string(stat), "(")+1 : i]
+		if len(fields) > 1 && fields[1] == strconv.Itoa(pid) && comm == name {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+func (s *DockerDaemonSuite) TestDaemonResourceSampler(c *check.C) {
+	testRequires(c, DaemonIsLinux, SameHostDaemon)
+	c.Assert(s.d.StartResourceSampler(time.Second), checker.NotNil)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	c.Assert(s.d.StartResourceSampler(100*time.Millisecond), checker.IsNil)
+	for i := 0; i < 5; i++ {
+		out, err := s.d.Cmd("run", "--rm", "busybox", "true")
+		c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	}
+	c.Assert(s.d.Stop(), checker.IsNil)
+
+	samples := s.d.ResourceSamples()
+	c.Assert(len(samples) > 1, checker.True, check.Commentf("%d samples", len(samples)))
+	last := samples[len(samples)-1]
+	c.Assert(last.RSS > 0, checker.True)
+	c.Assert(last.CPUTime > 0, checker.True)
+	c.Assert(last.Time.After(samples[0].Time), checker.True)
+
+	// no more samples are taken once the daemon is stopped
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(s.d.ResourceSamples(), checker.HasLen, len(samples))
+}
+
+func (s *DockerDaemonSuite) TestDaemonExportImportContainer(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "--name", "exported", "busybox", "sh", "-c", "echo roundtrip > /file")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+
+	tmpDir, err := ioutil.TempDir("", "export")
+	c.Assert(err, checker.IsNil)
+	defer os.RemoveAll(tmpDir)
+	archive := filepath.Join(tmpDir, "exported.tar")
+	c.Assert(s.d.ExportContainer("exported", archive), checker.IsNil)
+
+	id, err := s.d.ImportImage(archive, "imported:latest")
+	c.Assert(err, checker.IsNil)
+	c.Assert(id, checker.HasPrefix, "sha256:")
+
+	out, err = s.d.Cmd("run", "--rm", "imported:latest", "cat", "/file")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "roundtrip")
+}
+
+func (s *DockerDaemonSuite) TestDaemonNetworkInspect(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("network", "create", "--subnet", "10.77.0.0/24", "inspected")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id, err := s.d.RunContainer("busybox", "-i", "--net", "inspected")
+	c.Assert(err, checker.IsNil)
+
+	nw, err := s.d.NetworkInspect("inspected")
+	c.Assert(err, checker.IsNil)
+	c.Assert(nw.Scope, checker.Equals, "local")
+	c.Assert(nw.IPAM.Config, checker.HasLen, 1)
+	_, subnet, err := net.ParseCIDR(nw.IPAM.Config[0].Subnet)
+	c.Assert(err, checker.IsNil)
+
+	ep, ok := nw.Containers[id]
+	c.Assert(ok, checker.True, check.Commentf("%s not connected: %v", id, nw.Containers))
+	ip, _, err := net.ParseCIDR(ep.IPv4Address)
+	c.Assert(err, checker.IsNil)
+	c.Assert(subnet.Contains(ip), checker.True, check.Commentf("%s not in %s", ip, subnet))
+
+	_, err = s.d.NetworkInspect("doesnotexist")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonDefaultUlimitOverride(c *check.C) {
+	s.d.DefaultUlimits = []string{"nofile=1024:2048"}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	soft, hard, err := s.d.ContainerUlimit(id, "nofile")
+	c.Assert(err, checker.IsNil)
+	c.Assert(soft, checker.Equals, int64(1024))
+	c.Assert(hard, checker.Equals, int64(2048))
+
+	id, err = s.d.RunContainer("busybox", "-i", "--ulimit", "nofile=512:512")
+	c.Assert(err, checker.IsNil)
+	soft, hard, err = s.d.ContainerUlimit(id, "nofile")
+	c.Assert(err, checker.IsNil)
+	c.Assert(soft, checker.Equals, int64(512))
+	c.Assert(hard, checker.Equals, int64(512))
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerPID(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "sleep", "4321")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	pid, err := s.d.ContainerPID(id)
+	c.Assert(err, checker.IsNil)
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	c.Assert(err, checker.IsNil)
+	c.Assert(string(bytes.Replace(cmdline, []byte{0}, []byte(" "), -1)), checker.Contains, "sleep 4321")
+
+	c.Assert(s.d.StopContainer(id, 0), checker.IsNil)
+	_, err = s.d.ContainerPID(id)
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonUpdateConfig(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	c.Assert(s.d.UpdateConfig(map[string]interface{}{"debug": true}), checker.NotNil)
+
+	configFile := filepath.Join(s.d.folder, "daemon.json")
+	c.Assert(ioutil.WriteFile(configFile, []byte(`{"labels":["foo=bar"],"max-concurrent-downloads":1}`), 0644), checker.IsNil)
+	c.Assert(s.d.Start("--config-file", configFile), checker.IsNil)
+
+	since, err := s.d.ServerTime()
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.UpdateConfig(map[string]interface{}{"max-concurrent-downloads": 4}), checker.IsNil)
+
+	// the labels were kept in the file, so they are not reset by the reload
+	info, err := s.d.Info()
+	c.Assert(err, checker.IsNil)
+	c.Assert(info.Labels, checker.DeepEquals, []string{"foo=bar"})
+	until, err := s.d.ServerTime()
+	c.Assert(err, checker.IsNil)
+	out, err := s.d.Cmd("events", "--since", parseEventTime(since), "--until", parseEventTime(until), "--filter", "event=reload")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(out, checker.Contains, "max-concurrent-downloads=4")
+
+	err = s.d.UpdateConfig(map[string]interface{}{"max-concurrent-downloads": -1})
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "invalid max concurrent downloads")
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerDiff(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("create", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	changes, err := s.d.ContainerDiff(strings.TrimSpace(out))
+	c.Assert(err, checker.IsNil)
+	c.Assert(changes, checker.HasLen, 0)
+
+	out, err = s.d.Cmd("run", "-d", "busybox", "sh", "-c", "mkdir /added && touch /added/file && rm /bin/wget")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+	code, err := s.d.WaitForContainerExit(id, 10*time.Second)
+	c.Assert(err, checker.IsNil)
+	c.Assert(code, checker.Equals, 0)
+
+	changes, err = s.d.ContainerDiff(id)
+	c.Assert(err, checker.IsNil)
+	kinds := map[string]int{}
+	for _, ch := range changes {
+		kinds[ch.Path] = ch.Kind
+	}
+	c.Assert(kinds["/added"], checker.Equals, 1)
+	c.Assert(kinds["/added/file"], checker.Equals, 1)
+	c.Assert(kinds["/bin"], checker.Equals, 0)
+	c.Assert(kinds["/bin/wget"], checker.Equals, 2)
+}
+
+func (s *DockerDaemonSuite) TestDaemonCLIConfigIsolation(c *check.C) {
+	d2 := NewDaemon(c)
+	defer d2.Cleanup()
+	c.Assert(s.d.ConfigDir, checker.Not(checker.Equals), d2.ConfigDir)
+
+	c.Assert(s.d.WriteCLIConfig(map[string]interface{}{"psFormat": "name={{.Names}}"}), checker.IsNil)
+	c.Assert(d2.WriteCLIConfig(map[string]interface{}{"psFormat": "image={{.Image}}"}), checker.IsNil)
+	c.Assert(StartDaemons([]*Daemon{s.d, d2}), checker.IsNil)
+	c.Assert(s.d.LoadBusybox(), checker.IsNil)
+	c.Assert(d2.LoadBusybox(), checker.IsNil)
+
+	for _, d := range []*Daemon{s.d, d2} {
+		_, err := d.RunContainer("busybox", "-i", "--name", "isolated")
+		c.Assert(err, checker.IsNil)
+	}
+
+	out, err := s.d.Cmd("ps")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "name=isolated")
+	out, err = d2.Cmd("ps")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "image=busybox")
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerRestartCount(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "--restart=on-failure:2", "busybox", "false")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	err = waitInspectWithArgs(id, "{{.State.Restarting}} {{.RestartCount}}", "false 2", 30*time.Second, "--host", s.d.sock())
+	c.Assert(err, checker.IsNil)
+	count, err := s.d.ContainerRestartCount(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(count, checker.Equals, 2)
+
+	out, err = s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id = strings.TrimSpace(out)
+	pid, err := s.d.ContainerPID(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.RestartContainer(id, 1), checker.IsNil)
+	c.Assert(s.d.waitRun(id), checker.IsNil)
+	newPid, err := s.d.ContainerPID(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(newPid, checker.Not(checker.Equals), pid)
+}
+
+func (s *DockerDaemonSuite) TestDaemonAttach(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "-i", "busybox", "cat")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	attached := make(chan error, 1)
+	go func() {
+		attached <- s.d.Attach(ctx, id, stdinR, stdoutW)
+		stdoutW.Close()
+	}()
+
+	_, err = stdinW.Write([]byte("hello attach\n"))
+	c.Assert(err, checker.IsNil)
+	line, err := bufio.NewReader(stdoutR).ReadString('\n')
+	c.Assert(err, checker.IsNil)
+	c.Assert(line, checker.Equals, "hello attach\n")
+
+	// cancelling detaches without stopping the container
+	cancel()
+	select {
+	case err := <-attached:
+		c.Assert(err, checker.IsNil)
+	case <-time.After(10 * time.Second):
+		c.Fatal("attach did not return after cancellation")
+	}
+	c.Assert(s.d.waitRun(id), checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonAttachTLS(c *check.C) {
+	s.d.useDefaultTLSHost = true
+	defer func() {
+		s.d.useDefaultTLSHost = false
+	}()
+	c.Assert(s.d.StartWithBusybox(
+		"--tlsverify",
+		"--tlscacert", "fixtures/https/ca.pem",
+		"--tlscert", "fixtures/https/server-cert.pem",
+		"--tlskey", "fixtures/https/server-key.pem"), checker.IsNil)
+	s.d.APIVersion = "1.23"
+
+	// the container echoes its input, which it only gets once attached
+	out, err := s.d.Cmd("run", "-d", "-i", "busybox", "head", "-n", "1")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	id := strings.TrimSpace(out)
+
+	var stdout bytes.Buffer
+	err = s.d.Attach(context.Background(), id, strings.NewReader("hello tls\n"), &stdout)
+	c.Assert(err, checker.IsNil)
+	c.Assert(stdout.String(), checker.Equals, "hello tls\n")
+}
+
+func (s *DockerDaemonSuite) TestDaemonBuildNoCache(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	dockerfile := "FROM busybox\nRUN echo cached > /file"
+
+	out, err := s.d.BuildNoCache("nocache", dockerfile)
+	c.Assert(err, checker.IsNil)
+	c.Assert(out, checker.Not(checker.Contains), "Using cache")
+
+	out, _, err = s.d.buildImageWithOut("nocache", dockerfile, true)
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	c.Assert(out, checker.Contains, "Using cache")
+
+	out, err = s.d.BuildNoCache("nocache", dockerfile)
+	c.Assert(err, checker.IsNil)
+	c.Assert(out, checker.Not(checker.Contains), "Using cache")
+}
+
+func (s *DockerDaemonSuite) TestDaemonListContainers(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	running, err := s.d.RunContainer("busybox", "-i", "--label", "group=a")
+	c.Assert(err, checker.IsNil)
+	out, err := s.d.Cmd("run", "--label", "group=a", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	out, err = s.d.Cmd("run", "-d", "--label", "group=b", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf("%s", out))
+	exitedB := strings.TrimSpace(out)
+	_, err = s.d.WaitForContainerExit(exitedB, 10*time.Second)
+	c.Assert(err, checker.IsNil)
+
+	list, err := s.d.ListContainers(types.ContainerListOptions{})
+	c.Assert(err, checker.IsNil)
+	c.Assert(list, checker.HasLen, 1)
+	c.Assert(list[0].ID, checker.Equals, running)
+
+	list, err = s.d.ListContainers(types.ContainerListOptions{All: true})
+	c.Assert(err, checker.IsNil)
+	c.Assert(list, checker.HasLen, 3)
+
+	byLabel := filters.NewArgs()
+	byLabel.Add("label", "group=a")
+	list, err = s.d.ListContainers(types.ContainerListOptions{All: true, Filter: byLabel})
+	c.Assert(err, checker.IsNil)
+	c.Assert(list, checker.HasLen, 2)
+
+	byStatus := filters.NewArgs()
+	byStatus.Add("status", "exited")
+	byStatus.Add("label", "group=b")
+	list, err = s.d.ListContainers(types.ContainerListOptions{All: true, Filter: byStatus})
+	c.Assert(err, checker.IsNil)
+	c.Assert(list, checker.HasLen, 1)
+	c.Assert(list[0].ID, checker.Equals, exitedB)
+
+	list, err = s.d.ListContainers(types.ContainerListOptions{All: true, Limit: 2})
+	c.Assert(err, checker.IsNil)
+	c.Assert(list, checker.HasLen, 2)
+}
+
+func (s *DockerDaemonSuite) TestDaemonListImages(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	images, err := s.d.ListImages(types.ImageListOptions{})
+	c.Assert(err, checker.IsNil)
+	c.Assert(images, checker.HasLen, 1)
+
+	// every instruction leaves an untagged intermediate image behind
+	_, err = s.d.BuildNoCache("listed", "FROM busybox\nRUN touch /a\nRUN touch /b\nLABEL built=1")
+	c.Assert(err, checker.IsNil)
+	images, err = s.d.ListImages(types.ImageListOptions{})
+	c.Assert(err, checker.IsNil)
+	c.Assert(images, checker.HasLen, 2)
+	all, err := s.d.ListImages(types.ImageListOptions{All: true})
+	c.Assert(err, checker.IsNil)
+	c.Assert(all, checker.HasLen, 4)
+
+	dangling := filters.NewArgs()
+	dangling.Add("dangling", "true")
+	images, err = s.d.ListImages(types.ImageListOptions{Filters: dangling})
+	c.Assert(err, checker.IsNil)
+	c.Assert(images, checker.HasLen, 0)
+
+	// rebuilding moves the tag, which leaves the old image dangling
+	_, err = s.d.BuildNoCache("listed", "FROM busybox\nLABEL built=2")
+	c.Assert(err, checker.IsNil)
+	images, err = s.d.ListImages(types.ImageListOptions{Filters: dangling})
+	c.Assert(err, checker.IsNil)
+	c.Assert(images, checker.HasLen, 1)
+
+	byLabel := filters.NewArgs()
+	byLabel.Add("label", "built=2")
+	images, err = s.d.ListImages(types.ImageListOptions{Filters: byLabel})
+	c.Assert(err, checker.IsNil)
+	c.Assert(images, checker.HasLen, 1)
+	c.Assert(images[0].RepoTags, checker.DeepEquals, []string{"listed:latest"})
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerSeccompMode(c *check.C) {
+	testRequires(c, SameHostDaemon, seccompEnabled)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	profile := filepath.Join(s.d.folder, "deny-chmod.json")
+	err := ioutil.WriteFile(profile, []byte(`{
+	"defaultAction": "SCMP_ACT_ALLOW",
+	"syscalls": [
+		{
+			"name": "chmod",
+			"action": "SCMP_ACT_ERRNO"
+		}
+	]
+}`), 0644)
+	c.Assert(err, checker.IsNil)
+
+	for _, tc := range []struct {
+		opts []string
+		mode string
+	}{
+		{nil, "default"},
+		{[]string{"--security-opt", "seccomp=unconfined"}, "unconfined"},
+		{[]string{"--security-opt", "seccomp=" + profile}, "custom"},
+	} {
+		id, err := s.d.RunContainer("busybox", append([]string{"-i"}, tc.opts...)...)
+		c.Assert(err, checker.IsNil)
+		mode, err := s.d.ContainerSeccompMode(id)
+		c.Assert(err, checker.IsNil)
+		c.Assert(mode, checker.Equals, tc.mode)
+	}
+
+	id, err := s.d.RunContainer("busybox", "-i", "--security-opt", "seccomp="+profile)
+	c.Assert(err, checker.IsNil)
+	out, err := s.d.Cmd("exec", id, "chmod", "400", "/etc/hostname")
+	c.Assert(err, checker.NotNil, check.Commentf("chmod should be denied: %s", out))
+	c.Assert(out, checker.Contains, "Operation not permitted")
+}
+
+func (s *DockerDaemonSuite) TestDaemonAppArmorProfile(c *check.C) {
+	testRequires(c, SameHostDaemon, Apparmor)
+	if _, err := exec.LookPath("apparmor_parser"); err != nil {
+		c.Skip("apparmor_parser is not installed")
+	}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	profile := filepath.Join(s.d.folder, "docker-test-deny-tmp")
+	err := ioutil.WriteFile(profile, []byte(`#include <tunables/global>
+
+profile docker-test-deny-tmp flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+
+  deny /tmp/** wl,
+}
+`), 0644)
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.LoadAppArmorProfile(profile), checker.IsNil)
+
+	id, err := s.d.RunContainerWithAppArmor("busybox", "docker-test-deny-tmp", "-i")
+	c.Assert(err, checker.IsNil)
+	name, err := s.d.ContainerAppArmorProfile(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(name, checker.Equals, "docker-test-deny-tmp")
+
+	out, err := s.d.Cmd("exec", id, "touch", "/tmp/denied")
+	c.Assert(err, checker.NotNil, check.Commentf("write to /tmp should be denied: %s", out))
+	c.Assert(out, checker.Contains, "Permission denied")
+	out, err = s.d.Cmd("exec", id, "touch", "/allowed")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitForRemoval(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	// the client removes --rm containers once they exit, so run it in the
+	// background to observe the container while it still exists
+	errCh := make(chan error, 1)
+	go func() {
+		out, err := s.d.Cmd("run", "--rm", "--name", "removeme", "busybox", "sleep", "2")
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, out)
+		}
+		errCh <- err
+	}()
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		if _, err := s.d.inspectFilter("removeme", ".Id"); err == nil {
+			break
+		}
+		c.Assert(time.Since(start) < 10*time.Second, checker.True, check.Commentf("container was never created"))
+	}
+
+	c.Assert(s.d.WaitForRemoval("removeme", 30*time.Second), checker.IsNil)
+	c.Assert(<-errCh, checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "--name", "persists", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(s.d.WaitForRemoval("persists", time.Second), checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonExecInspect(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	execID, err := s.d.ExecDetach(id, "sh", "-c", "sleep 2; exit 3")
+	c.Assert(err, checker.IsNil)
+
+	inspect, err := s.d.ExecInspect(execID)
+	c.Assert(err, checker.IsNil)
+	c.Assert(inspect.ExecID, checker.Equals, execID)
+	c.Assert(inspect.ContainerID, checker.Equals, id)
+	c.Assert(inspect.Running, checker.True)
+	c.Assert(inspect.ExitCode, checker.Equals, 0)
+
+	for start := time.Now(); inspect.Running; time.Sleep(100 * time.Millisecond) {
+		c.Assert(time.Since(start) < 30*time.Second, checker.True, check.Commentf("exec %s still running", execID))
+		inspect, err = s.d.ExecInspect(execID)
+		c.Assert(err, checker.IsNil)
+	}
+	c.Assert(inspect.ExitCode, checker.Equals, 3)
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerEnv(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	_, err := s.d.BuildNoCache("envimage", "FROM busybox\nENV FROM_IMAGE=image OVERRIDDEN=image")
+	c.Assert(err, checker.IsNil)
+
+	envFile := filepath.Join(s.d.folder, "env.list")
+	c.Assert(ioutil.WriteFile(envFile, []byte("FROM_FILE=file\nOVERRIDDEN=file\n"), 0644), checker.IsNil)
+
+	// the container has exited, so the environment can't be read with exec
+	out, err := s.d.Cmd("run", "-d", "--env-file", envFile, "-e", "OVERRIDDEN=flag", "-e", "EMPTY=", "envimage", "true")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+	_, err = s.d.WaitForContainerExit(id, 30*time.Second)
+	c.Assert(err, checker.IsNil)
+
+	env, err := s.d.ContainerEnv(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(env["FROM_IMAGE"], checker.Equals, "image")
+	c.Assert(env["FROM_FILE"], checker.Equals, "file")
+	c.Assert(env["OVERRIDDEN"], checker.Equals, "flag")
+	value, ok := env["EMPTY"]
+	c.Assert(ok, checker.True)
+	c.Assert(value, checker.Equals, "")
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerMounts(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	bind := filepath.Join(s.d.folder, "bind")
+	c.Assert(os.Mkdir(bind, 0755), checker.IsNil)
+	id, err := s.d.RunContainer("busybox", "-i",
+		"-v", bind+":/bind:ro",
+		"-v", "data:/data",
+		"--tmpfs", "/scratch:ro,size=1m")
+	c.Assert(err, checker.IsNil)
+
+	mounts, err := s.d.ContainerMounts(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(mounts, checker.HasLen, 3)
+	byDest := make(map[string]types.MountPoint)
+	for _, m := range mounts {
+		byDest[m.Destination] = m
+	}
+
+	m := byDest["/bind"]
+	c.Assert(m.Source, checker.Equals, bind)
+	c.Assert(m.Mode, checker.Equals, "ro")
+	c.Assert(m.RW, checker.False)
+
+	m = byDest["/data"]
+	c.Assert(m.Name, checker.Equals, "data")
+	c.Assert(m.Driver, checker.Equals, "local")
+	c.Assert(m.RW, checker.True)
+
+	m = byDest["/scratch"]
+	c.Assert(m.Source, checker.Equals, "tmpfs")
+	c.Assert(m.Mode, checker.Equals, "ro,size=1m")
+	c.Assert(m.RW, checker.False)
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartTimings(c *check.C) {
+	c.Assert(s.d.Start(), checker.IsNil)
+	first, err := s.d.StartTimings()
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.Restart(), checker.IsNil)
+
+	// only the last start is measured, although the log covers both
+	timings, err := s.d.StartTimings()
+	c.Assert(err, checker.IsNil)
+	c.Assert(timings, checker.Not(checker.DeepEquals), first)
+	var sum time.Duration
+	for _, phase := range []string{"graphdriver", "daemon", "api"} {
+		d, ok := timings[phase]
+		c.Assert(ok, checker.True, check.Commentf("phase %s missing: %v", phase, timings))
+		c.Assert(d >= 0, checker.True, check.Commentf("phase %s: %v", phase, d))
+		sum += d
+	}
+	c.Assert(timings["total"] > 0, checker.True, check.Commentf("%v", timings))
+	c.Assert(timings["total"] >= sum, checker.True, check.Commentf("%v", timings))
+	c.Assert(timings["total"] < s.d.StartupDuration(), checker.True, check.Commentf("%v", timings))
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitForOOM(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunOOMContainer("32M")
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.WaitForOOM(id, time.Minute), checker.IsNil)
+	_, err = s.d.WaitForContainerExit(id, 30*time.Second)
+	c.Assert(err, checker.IsNil)
+	exitCode, err := s.d.ContainerExitCode(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(exitCode, checker.Equals, 137)
+
+	out, err := s.d.Cmd("run", "-d", "--memory", "32M", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(s.d.WaitForOOM(strings.TrimSpace(out), time.Second), checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonEngineLabels(c *check.C) {
+	s.d.Labels = []string{"novalue"}
+	c.Assert(s.d.Start(), checker.NotNil)
+	s.d.Labels = []string{"=value"}
+	c.Assert(s.d.Start(), checker.NotNil)
+
+	s.d.Labels = []string{"com.example.storage=ssd", "com.example.zone=a=b"}
+	c.Assert(s.d.Start(), checker.IsNil)
+	info, err := s.d.Info()
+	c.Assert(err, checker.IsNil)
+	c.Assert(info.Labels, checker.DeepEquals, []string{"com.example.storage=ssd", "com.example.zone=a=b"})
+}
+
+func (s *DockerDaemonSuite) TestDaemonBuildAndImportFromURL(c *check.C) {
+	testRequires(c, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	tarFiles := func(files map[string]string) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for name, content := range files {
+			c.Assert(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}), checker.IsNil)
+			_, err := tw.Write([]byte(content))
+			c.Assert(err, checker.IsNil)
+		}
+		c.Assert(tw.Close(), checker.IsNil)
+		return buf
+	}
+	server, err := fakeBinaryStorage(map[string]*bytes.Buffer{
+		"context.tar": tarFiles(map[string]string{
+			"Dockerfile": "FROM busybox\nCOPY hello /hello\n",
+			"hello":      "from the context",
+		}),
+		"rootfs.tar": tarFiles(map[string]string{"hello": "from the rootfs"}),
+	})
+	c.Assert(err, checker.IsNil)
+	defer server.Close()
+	c.Assert(ioutil.WriteFile(filepath.Join(server.CtxDir(), "Dockerfile"), []byte("FROM busybox\nLABEL remote=true\n"), 0644), checker.IsNil)
+
+	id, out, err := s.d.BuildFromURL("fromtar", server.URL()+"/context.tar")
+	c.Assert(err, checker.IsNil)
+	c.Assert(id, checker.Not(checker.Equals), "")
+	out, err = s.d.Cmd("run", "--rm", "fromtar", "cat", "/hello")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(out, checker.Equals, "from the context")
+
+	_, _, err = s.d.BuildFromURL("fromdockerfile", server.URL()+"/Dockerfile")
+	c.Assert(err, checker.IsNil)
+	label, err := s.d.inspectFilter("fromdockerfile", `index .Config.Labels "remote"`)
+	c.Assert(err, checker.IsNil)
+	c.Assert(label, checker.Equals, "true")
+
+	_, _, err = s.d.BuildFromURL("missing", server.URL()+"/missing.tar")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "404")
+
+	id, err = s.d.ImportFromURL(server.URL()+"/rootfs.tar", "imported")
+	c.Assert(err, checker.IsNil)
+	imported, err := s.d.inspectFilter("imported", ".Id")
+	c.Assert(err, checker.IsNil)
+	c.Assert(imported, checker.Equals, id)
+
+	_, err = s.d.ImportFromURL(server.URL()+"/missing.tar", "missing")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "404")
+	_, err = s.d.ImportFromURL(filepath.Join(server.CtxDir(), "rootfs.tar"), "missing")
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonEffectiveLogLevel(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	configFile := filepath.Join(s.d.folder, "daemon.json")
+	c.Assert(ioutil.WriteFile(configFile, []byte(`{"debug":true}`), 0644), checker.IsNil)
+	// an explicit log level keeps Start from adding --debug, which can't
+	// be reloaded. Disabling debug on reload resets the level to info.
+	c.Assert(s.d.Start("--config-file", configFile, "--log-level=warn"), checker.IsNil)
+
+	level, err := s.d.EffectiveLogLevel()
+	c.Assert(err, checker.IsNil)
+	c.Assert(level, checker.Equals, "debug")
+
+	c.Assert(s.d.UpdateConfig(map[string]interface{}{"debug": false}), checker.IsNil)
+	// debug is toggled right after the reload event is sent
+	for start := time.Now(); level == "debug" && time.Since(start) < reloadTimeout; time.Sleep(100 * time.Millisecond) {
+		level, err = s.d.EffectiveLogLevel()
+		c.Assert(err, checker.IsNil)
+	}
+	c.Assert(level, checker.Equals, "info")
+
+	// without debug the level given at start applies
+	c.Assert(s.d.Restart("--config-file", configFile, "--log-level=warn"), checker.IsNil)
+	level, err = s.d.EffectiveLogLevel()
+	c.Assert(err, checker.IsNil)
+	c.Assert(level, checker.Equals, "warn")
+}
+
+func (s *DockerDaemonSuite) TestDaemonNoForceDebug(c *check.C) {
+	// a flag merely containing -D does not count as a debug flag
+	c.Assert(s.d.Start("--label=com.example-Debug=1"), checker.IsNil)
+	forced := false
+	for _, a := range s.d.cmd.Args {
+		forced = forced || a == "--debug"
+	}
+	c.Assert(forced, checker.True, check.Commentf("%v", s.d.cmd.Args))
+	info, err := s.d.Info()
+	c.Assert(err, checker.IsNil)
+	c.Assert(info.Debug, checker.True)
+
+	s.d.NoForceDebug = true
+	c.Assert(s.d.Restart(), checker.IsNil)
+	for _, a := range s.d.cmd.Args {
+		c.Assert(a, checker.Not(checker.Equals), "--debug")
+	}
+	info, err = s.d.Info()
+	c.Assert(err, checker.IsNil)
+	c.Assert(info.Debug, checker.False)
+	level, err := s.d.EffectiveLogLevel()
+	c.Assert(err, checker.IsNil)
+	c.Assert(level, checker.Equals, "info")
+}
+
+func (s *DockerDaemonSuite) TestDaemonV2Registry(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	reg, err := NewV2Registry(c, WithRegistryAuth())
+	c.Assert(err, checker.IsNil)
+	defer reg.Close()
+
+	defer s.d.Cleanup()
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	repoName := reg.Addr + "/dockercli/busybox"
+	c.Assert(s.d.TagImage("busybox", repoName), checker.IsNil)
+	c.Assert(s.d.PushImage(repoName), checker.NotNil)
+	c.Assert(s.d.Login(reg.Addr, reg.Username, reg.Password), checker.IsNil)
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+
+	d := NewDaemon(c)
+	c.Assert(d.Start(), checker.IsNil)
+	defer d.Stop()
+	c.Assert(d.Login(reg.Addr, reg.Username, reg.Password), checker.IsNil)
+	_, err = d.PullImage(repoName)
+	c.Assert(err, checker.IsNil)
+	out, err := d.Cmd("run", "--rm", repoName, "echo", "pulled")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "pulled")
+}
+
+func (s *DockerDaemonSuite) TestDaemonProxyConfig(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+
+	var (
+		mu   sync.Mutex
+		hits []string
+	)
+	// the proxy only records which hosts it was asked to reach
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits = append(hits, r.Host)
+		mu.Unlock()
+		http.Error(w, "proxy says no", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	// loopback addresses are never proxied, so use a name that doesn't resolve
+	s.d.ProxyConfig = ProxyConfig{HTTP: proxy.URL, HTTPS: proxy.URL, NoProxy: "direct.invalid"}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	config, err := s.d.EffectiveProxyConfig()
+	c.Assert(err, checker.IsNil)
+	c.Assert(config, checker.Equals, s.d.ProxyConfig)
+
+	_, err = s.d.PullImage("proxied.invalid:5000/busybox")
+	c.Assert(err, checker.NotNil)
+	_, err = s.d.PullImage("direct.invalid:5000/busybox")
+	c.Assert(err, checker.NotNil)
+	mu.Lock()
+	c.Assert(strings.Join(hits, " "), checker.Contains, "proxied.invalid:5000")
+	c.Assert(strings.Join(hits, " "), checker.Not(checker.Contains), "direct.invalid")
+	mu.Unlock()
+
+	// the daemon's proxy is not passed on to containers
+	out, err := s.d.Cmd("run", "--rm", "busybox", "env")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(strings.ToLower(out), checker.Not(checker.Contains), "_proxy=")
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerLogPath(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "--log-opt", "max-size=1k", "--log-opt", "max-file=3",
+		"busybox", "sh", "-c", "for i in $(seq 1 200); do echo line $i of the rotated log; done")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+	_, err = s.d.WaitForContainerExit(id, 30*time.Second)
+	c.Assert(err, checker.IsNil)
+
+	logPath, err := s.d.ContainerLogPath(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(filepath.IsAbs(logPath), checker.True, check.Commentf(logPath))
+	c.Assert(strings.HasPrefix(logPath, s.d.folder), checker.True, check.Commentf(logPath))
+	for _, p := range []string{logPath, logPath + ".1", logPath + ".2"} {
+		fi, err := os.Stat(p)
+		c.Assert(err, checker.IsNil)
+		c.Assert(fi.Size() <= 1024, checker.True, check.Commentf("%s has %d bytes", p, fi.Size()))
+	}
+	_, err = os.Stat(logPath + ".3")
+	c.Assert(os.IsNotExist(err), checker.True)
+
+	out, err = s.d.Cmd("run", "-d", "--log-driver", "none", "busybox", "true")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	_, err = s.d.ContainerLogPath(strings.TrimSpace(out))
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "no log file for driver none")
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerDevices(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i", "--device", "/dev/null:/dev/testnull:rw")
+	c.Assert(err, checker.IsNil)
+	devices, err := s.d.ContainerDevices(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(devices, checker.HasLen, 1)
+	c.Assert(devices[0].PathOnHost, checker.Equals, "/dev/null")
+	c.Assert(devices[0].PathInContainer, checker.Equals, "/dev/testnull")
+	c.Assert(devices[0].CgroupPermissions, checker.Equals, "rw")
+	out, err := s.d.Cmd("exec", id, "sh", "-c", "test -c /dev/testnull && echo hello > /dev/testnull && cat /dev/testnull")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	id, err = s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	devices, err = s.d.ContainerDevices(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(devices, checker.HasLen, 0)
+	// writing would just create a regular file in /dev
+	out, err = s.d.Cmd("exec", id, "test", "-c", "/dev/testnull")
+	c.Assert(err, checker.NotNil, check.Commentf(out))
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitForPort(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "-p", "80", "busybox", "sh", "-c",
+		`while true; do printf 'HTTP/1.0 200 OK\r\n\r\nhello' | nc -l -p 80; done`)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+
+	hostPort, err := s.d.WaitForPort(id, "80", 30*time.Second)
+	c.Assert(err, checker.IsNil)
+	c.Assert(hostPort, checker.Not(checker.Equals), "80")
+
+	// the userland proxy accepts connections before nc listens, so the
+	// request may still have to be retried
+	var body []byte
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		resp, err := http.Get("http://127.0.0.1:" + hostPort)
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil {
+				break
+			}
+		}
+		c.Assert(time.Since(start) < 30*time.Second, checker.True, check.Commentf("%v", err))
+	}
+	c.Assert(string(body), checker.Equals, "hello")
+
+	_, err = s.d.WaitForPort(id, "81", time.Second)
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonManageIptablesDisabled(c *check.C) {
+	testRequires(c, SameHostDaemon, DaemonIsLinux)
+	if _, err := exec.LookPath("iptables"); err != nil {
+		c.Skip("iptables is not installed")
+	}
+	// other daemons of the host may have created the chains already
+	before, err := dockerIptablesChains("nat")
+	c.Assert(err, checker.IsNil)
+
+	manage := false
+	s.d.ManageIptables = &manage
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	out, err := s.d.Cmd("run", "-d", "-p", "127.0.0.1:45678:80", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	after, err := dockerIptablesChains("nat")
+	c.Assert(err, checker.IsNil)
+	c.Assert(after, checker.DeepEquals, before)
+	rules, err := exec.Command("iptables", "-t", "nat", "-S").CombinedOutput()
+	c.Assert(err, checker.IsNil, check.Commentf("%s", rules))
+	c.Assert(string(rules), checker.Not(checker.Contains), "--dport 45678")
+
+	// the port is still published through the userland proxy
+	_, err = s.d.WaitForPort(strings.TrimSpace(out), "80", 10*time.Second)
+	c.Assert(err, checker.IsNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonCreateContainer(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.CreateContainer("busybox", "--memory", "64m", "--cpu-shares", "512", "--restart", "on-failure:3")
+	c.Assert(err, checker.IsNil)
+	out, err := s.d.inspectFilter(id, `printf "%s %d %d %s %d" .State.Status .HostConfig.Memory .HostConfig.CPUShares .HostConfig.RestartPolicy.Name .HostConfig.RestartPolicy.MaximumRetryCount`)
+	c.Assert(err, checker.IsNil)
+	c.Assert(out, checker.Equals, "created 67108864 512 on-failure 3")
+	cmd, err := s.d.inspectFilter(id, "json .Config.Cmd")
+	c.Assert(err, checker.IsNil)
+	c.Assert(cmd, checker.Equals, `["sh"]`)
+
+	_, err = s.d.CreateContainer("busybox", "--memory", "1m")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "Minimum memory limit allowed is 4MB")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCmdWithTTY(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.CmdWithTTY("run", "--rm", "-t", "busybox", "tty")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(out, checker.Contains, "/dev/pts/")
+	c.Assert(out, checker.HasSuffix, "\r\n")
+
+	out, err = s.d.Cmd("run", "--rm", "busybox", "tty")
+	c.Assert(err, checker.NotNil)
+	c.Assert(out, checker.Contains, "not a tty")
+}
+
+func (s *DockerDaemonSuite) TestDaemonResizeContainer(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i", "-t")
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.ResizeContainer(id, 42, 123), checker.IsNil)
+	// the TTY of the container is the standard input of its first process
+	out, err := s.d.Cmd("exec", id, "stty", "-F", "/proc/1/fd/0", "size")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "42 123")
+
+	err = s.d.ResizeExec("doesnotexist", 42, 123)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "No such exec instance")
+
+	c.Assert(s.d.StopContainer(id, 0), checker.IsNil)
+	err = s.d.ResizeContainer(id, 42, 123)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "is not running")
+}
+
+func (s *DockerDaemonSuite) TestDaemonCountEvents(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("create", "--restart=on-failure:3", "busybox", "false")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+
+	type result struct {
+		action string
+		count  int
+		err    error
+	}
+	results := make(chan result, 2)
+	for _, action := range []string{"start", "die"} {
+		go func(action string) {
+			n, err := s.d.CountEvents(context.Background(), "container", action, 10*time.Second)
+			results <- result{action, n, err}
+		}(action)
+	}
+	// the events are counted from before the subscriptions, once both are
+	// established none of the container's events can be missed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := s.d.Info()
+		c.Assert(err, checker.IsNil)
+		if info.NEventsListener >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("only %d events subscriptions established", info.NEventsListener)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	out, err = s.d.Cmd("start", id)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	counts := map[string]int{}
+	for i := 0; i < 2; i++ {
+		r := <-results
+		c.Assert(r.err, checker.IsNil)
+		counts[r.action] = r.count
+	}
+	// the first run plus three restarts, each ending with a die
+	c.Assert(counts["start"], checker.Equals, 4)
+	c.Assert(counts["die"], checker.Equals, 4)
+	restarts, err := s.d.ContainerRestartCount(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(restarts, checker.Equals, 3)
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerCgroupPath(c *check.C) {
+	testRequires(c, DaemonIsLinux, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	cgroupParent := "/cgroup-parent/test"
+	id, err := s.d.RunContainer("busybox", "--cgroup-parent", cgroupParent, "-i")
+	c.Assert(err, checker.IsNil)
+
+	parent, err := s.d.ContainerCgroupParent(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(parent, checker.Equals, cgroupParent)
+
+	dir, err := s.d.ContainerCgroupPath(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(filepath.ToSlash(dir), checker.HasSuffix, path.Join(cgroupParent, id))
+	_, err = os.Stat(dir)
+	c.Assert(err, checker.IsNil)
+
+	id, err = s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	parent, err = s.d.ContainerCgroupParent(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(parent, checker.Equals, "")
+}
+
+func (s *DockerDaemonSuite) TestDaemonWaitForContainerLog(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	ready := regexp.MustCompile(`^listening on \d+$`)
+	out, err := s.d.Cmd("run", "-d", "busybox", "sh", "-c", "echo starting; sleep 2; echo listening on 8080; exec nc -l -p 8080")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(s.d.WaitForContainerLog(strings.TrimSpace(out), ready, 30*time.Second), checker.IsNil)
+
+	out, err = s.d.Cmd("run", "-d", "busybox", "sh", "-c", "echo starting; exit 3")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	err = s.d.WaitForContainerLog(strings.TrimSpace(out), ready, 30*time.Second)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "exited with code 3")
+	c.Assert(err.Error(), checker.Contains, "starting")
+
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	err = s.d.WaitForContainerLog(id, ready, time.Second)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "within 1s")
+}
+
+func (s *DockerDaemonSuite) TestDaemonDNS(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	s.d.DNS = []string{"not-an-ip"}
+	c.Assert(s.d.Start(), checker.NotNil)
+
+	s.d.DNS = []string{"1.2.3.4"}
+	s.d.DNSSearch = []string{"example.com"}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	conf, err := s.d.ContainerResolvConf(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(conf, checker.Contains, "nameserver 1.2.3.4")
+	c.Assert(conf, checker.Contains, "search example.com")
+
+	id, err = s.d.RunContainer("busybox", "-i", "--dns", "4.3.2.1", "--dns-search", "example.org")
+	c.Assert(err, checker.IsNil)
+	conf, err = s.d.ContainerResolvConf(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(conf, checker.Contains, "nameserver 4.3.2.1")
+	c.Assert(conf, checker.Contains, "search example.org")
+	c.Assert(conf, checker.Not(checker.Contains), "1.2.3.4")
+
+	// the embedded DNS server of user-defined networks hides the nameservers
+	out, err := s.d.Cmd("network", "create", "dnstest")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id, err = s.d.RunContainer("busybox", "-i", "--net", "dnstest")
+	c.Assert(err, checker.IsNil)
+	conf, err = s.d.ContainerResolvConf(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(conf, checker.Contains, "nameserver 127.0.0.11")
+	c.Assert(conf, checker.Not(checker.Contains), "1.2.3.4")
+}
+
+func (s *DockerDaemonSuite) TestDaemonUsernsRemap(c *check.C) {
+	testRequires(c, DaemonIsLinux, SameHostDaemon, UserNamespaceInKernel, NotUserNamespace)
+	s.d.UsernsRemap = "default"
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	// the remapped daemon keeps its data in a "uid.gid" directory
+	uidgid := strings.Split(filepath.Base(s.d.rootDir()), ".")
+	c.Assert(uidgid, checker.HasLen, 2, check.Commentf("root %s is not remapped", s.d.rootDir()))
+	remappedUID, err := strconv.Atoi(uidgid[0])
+	c.Assert(err, checker.IsNil)
+	c.Assert(remappedUID, checker.Not(checker.Equals), 0)
+
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	out, err := s.d.Cmd("exec", id, "id", "-u")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(strings.TrimSpace(out), checker.Equals, "0")
+	uid, err := s.d.ContainerHostUID(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(uid, checker.Equals, remappedUID)
+
+	id, err = s.d.RunContainer("busybox", "-i", "--userns", "host")
+	c.Assert(err, checker.IsNil)
+	uid, err = s.d.ContainerHostUID(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(uid, checker.Equals, 0)
+
+	// turning remapping off again uses the original root
+	s.d.UsernsRemap = ""
+	c.Assert(s.d.Restart(), checker.IsNil)
+	c.Assert(filepath.Base(s.d.rootDir()), checker.Equals, "root")
+	// images are not shared with the remapped root
+	c.Assert(s.d.LoadBusybox(), checker.IsNil)
+	id, err = s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+	uid, err = s.d.ContainerHostUID(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(uid, checker.Equals, 0)
+}
+
+func (s *DockerDaemonSuite) TestDaemonStartWithConfig(c *check.C) {
+	err := s.d.StartWithConfig(map[string]interface{}{"labels": []string{"com.example.from=file"}}, "--label", "com.example.from=flag")
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "specified both as a flag and in the configuration file")
+
+	config := map[string]interface{}{
+		"debug":  false,
+		"labels": []string{"com.example.from=file"},
+	}
+	c.Assert(s.d.StartWithConfig(config), checker.IsNil)
+	info, err := s.d.Info()
+	c.Assert(err, checker.IsNil)
+	c.Assert(info.Labels, checker.DeepEquals, []string{"com.example.from=file"})
+	// the file turned debug off and Start did not force it on
+	c.Assert(info.Debug, checker.False)
+}
+
+func (s *DockerDaemonSuite) TestDaemonContainerExists(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	id, err := s.d.RunContainer("busybox", "-i", "--name", "exists")
+	c.Assert(err, checker.IsNil)
+	for _, ref := range []string{id, "exists"} {
+		exists, err := s.d.ContainerExists(ref)
+		c.Assert(err, checker.IsNil)
+		c.Assert(exists, checker.True)
+	}
+
+	out, err := s.d.Cmd("rm", "-f", id)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	exists, err := s.d.ContainerExists(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(exists, checker.False)
+	s.d.AssertContainerGone(c, "exists")
+
+	// a daemon that can't be reached is not mistaken for a missing container
+	c.Assert(s.d.Stop(), checker.IsNil)
+	_, err = s.d.ContainerExists(id)
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonBuildWithContext(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	_, _, err := s.d.BuildWithContext("ctxtest", map[string]string{"../escape": ""})
+	c.Assert(err, checker.NotNil)
+
+	files := map[string]string{
+		"Dockerfile":     "FROM busybox\nCOPY . /ctx/\n",
+		"data/hello.txt": "hello",
+		"secret.txt":     "secret",
+		".dockerignore":  "secret.txt\n",
+	}
+	id, out, err := s.d.BuildWithContext("ctxtest", files)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(id, checker.Not(checker.Equals), "")
+
+	out, err = s.d.Cmd("run", "--rm", "ctxtest", "cat", "/ctx/data/hello.txt")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(out, checker.Equals, "hello")
+	out, err = s.d.Cmd("run", "--rm", "ctxtest", "ls", "-A", "/ctx")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(out, checker.Not(checker.Contains), "secret.txt")
+}
+
+func (s *DockerDaemonSuite) TestDaemonBridgeInterface(c *check.C) {
+	testRequires(c, DaemonIsLinux, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	name, err := s.d.BridgeInterface()
+	c.Assert(err, checker.IsNil)
+	c.Assert(name, checker.Equals, "docker0")
+
+	// the bridge is shared with the other daemons of the host, so only
+	// check what any of them sets up
+	iface, err := s.d.BridgeHostInterface()
+	c.Assert(err, checker.IsNil)
+	c.Assert(iface.Name, checker.Equals, "docker0")
+	c.Assert(iface.Up, checker.True)
+	c.Assert(iface.MTU, checker.GreaterThan, 0)
+	c.Assert(iface.Addrs, checker.Not(checker.HasLen), 0)
+
+	c.Assert(s.d.Restart("--bridge", "none"), checker.IsNil)
+	_, err = s.d.BridgeInterface()
+	c.Assert(err, checker.NotNil)
+}
+
+func (s *DockerDaemonSuite) TestDaemonCollectDiagnostics(c *check.C) {
+	testRequires(c, DaemonIsLinux, SameHostDaemon)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	id, err := s.d.RunContainer("busybox", "-i")
+	c.Assert(err, checker.IsNil)
+
+	collect := func() string {
+		destDir, err := ioutil.TempDir("", "diagnostics")
+		c.Assert(err, checker.IsNil)
+		c.Assert(s.d.CollectDiagnostics(destDir), checker.IsNil)
+		dirs, err := ioutil.ReadDir(destDir)
+		c.Assert(err, checker.IsNil)
+		c.Assert(dirs, checker.HasLen, 1)
+		return filepath.Join(destDir, dirs[0].Name())
+	}
+
+	dir := collect()
+	defer os.RemoveAll(filepath.Dir(dir))
+	for _, name := range []string{"info.json", "containers.json", "images.json", "networks.json", "goroutine-stacks.txt", "daemon.log"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		c.Assert(err, checker.IsNil)
+	}
+	_, err = os.Stat(filepath.Join(dir, "errors.txt"))
+	c.Assert(os.IsNotExist(err), checker.True)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "containers.json"))
+	c.Assert(err, checker.IsNil)
+	c.Assert(string(b), checker.Contains, id)
+	b, err = ioutil.ReadFile(filepath.Join(dir, "goroutine-stacks.txt"))
+	c.Assert(err, checker.IsNil)
+	stacks := string(b)
+	c.Assert(strings.HasPrefix(stacks, stackDumpBegin), checker.True, check.Commentf(stacks))
+	// the stacks of all goroutines, starting with the one dumping them
+	c.Assert(stacks, checker.Contains, "goroutine 1 [")
+	c.Assert(stacks, checker.Contains, "github.com/docker/docker/pkg/signal.DumpStacks(")
+
+	// a crashed daemon still leaves its log behind
+	c.Assert(s.d.Kill(), checker.IsNil)
+	dir = collect()
+	defer os.RemoveAll(filepath.Dir(dir))
+	_, err = os.Stat(filepath.Join(dir, "daemon.log"))
+	c.Assert(err, checker.IsNil)
+	b, err = ioutil.ReadFile(filepath.Join(dir, "errors.txt"))
+	c.Assert(err, checker.IsNil)
+	c.Assert(string(b), checker.Contains, "info.json")
+	c.Assert(string(b), checker.Contains, "goroutine-stacks.txt")
+}
@@ -42,3 +42,29 @@ func (s *DockerRegistryAuthHtpasswdSuite) TestLoginToPrivateRegistryDeprecatedEm
 	// --email flag
 	dockerCmd(c, "login", "-u", s.reg.username, "-p", s.reg.password, "--email", s.reg.email, privateRegistryURL)
 }
+
+func (s *DockerRegistryAuthHtpasswdSuite) TestDaemonLoginLogout(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	repoName := privateRegistryURL + "/dockercli/daemon-login"
+	c.Assert(s.d.TagImage("busybox", repoName), checker.IsNil)
+
+	c.Assert(s.d.PushImage(repoName), checker.NotNil)
+	c.Assert(s.d.Login(privateRegistryURL, s.reg.username, "WRONGPASSWORD"), checker.NotNil)
+	c.Assert(s.d.Login(privateRegistryURL, s.reg.username, s.reg.password), checker.IsNil)
+
+	// the credentials are not visible to the CLI outside of the daemon
+	out, _, err := dockerCmdWithError("pull", repoName)
+	c.Assert(err, checker.NotNil, check.Commentf("%s", out))
+
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+	_, err = s.d.RemoveImage(repoName, false)
+	c.Assert(err, checker.IsNil)
+	_, err = s.d.PullImage(repoName)
+	c.Assert(err, checker.IsNil)
+
+	c.Assert(s.d.Logout(privateRegistryURL), checker.IsNil)
+	_, err = s.d.RemoveImage(repoName, false)
+	c.Assert(err, checker.IsNil)
+	_, err = s.d.PullImage(repoName)
+	c.Assert(err, checker.NotNil)
+}
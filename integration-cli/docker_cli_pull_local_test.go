@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/digest"
@@ -16,7 +17,9 @@ import (
 	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/docker/pkg/integration/checker"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/go-check/check"
+	"golang.org/x/net/context"
 )
 
 // testPullImageWithAliases pulls a specific image tag and verifies that any aliases (i.e., other
@@ -444,3 +447,193 @@ func (s *DockerRegistrySuite) TestRunImplicitPullWithNoTag(c *check.C) {
 	splitOutImageCmd := strings.Split(strings.TrimSpace(outImageCmd), "\n")
 	c.Assert(splitOutImageCmd, checker.HasLen, 2)
 }
+
+func (s *DockerRegistrySuite) TestDaemonPushPullImage(c *check.C) {
+	s.d.InsecureRegistries = []string{privateRegistryURL}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	repoName := fmt.Sprintf("%v/dockercli/daemon-roundtrip", privateRegistryURL)
+	out, err := s.d.Cmd("tag", "busybox", repoName)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	expected, err := s.d.getIDByName(repoName)
+	c.Assert(err, checker.IsNil)
+
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+	out, err = s.d.Cmd("rmi", repoName)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+
+	id, err := s.d.PullImage(repoName)
+	c.Assert(err, checker.IsNil)
+	c.Assert(id, checker.Equals, expected)
+
+	_, err = s.d.PullImage(privateRegistryURL + "/dockercli/doesnotexist")
+	c.Assert(err, checker.NotNil)
+	rerr, ok := err.(registryError)
+	c.Assert(ok, checker.True, check.Commentf("%T: %v", err, err))
+	c.Assert(rerr.cause, checker.Equals, errImageNotFound, check.Commentf("%v", err))
+}
+
+func (s *DockerRegistrySuite) TestDaemonRegistryConfig(c *check.C) {
+	s.d.InsecureRegistries = []string{"http://" + privateRegistryURL}
+	c.Assert(s.d.Start(), checker.NotNil)
+	s.d.InsecureRegistries = []string{privateRegistryURL}
+	s.d.RegistryMirrors = []string{"http://" + privateRegistryURL + "/v2/"}
+	c.Assert(s.d.Start(), checker.NotNil)
+
+	s.d.RegistryMirrors = []string{"http://mirror.invalid:5000"}
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	info, err := s.d.Info()
+	c.Assert(err, checker.IsNil)
+	c.Assert(info.RegistryConfig.Mirrors, checker.DeepEquals, []string{"http://mirror.invalid:5000/"})
+	index, ok := info.RegistryConfig.IndexConfigs[privateRegistryURL]
+	c.Assert(ok, checker.True, check.Commentf("%v", info.RegistryConfig.IndexConfigs))
+	c.Assert(index.Secure, checker.False)
+
+	// mirrors are only used for the official index
+	repoName := fmt.Sprintf("%v/dockercli/insecure", privateRegistryURL)
+	c.Assert(s.d.TagImage("busybox", repoName), checker.IsNil)
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+	_, err = s.d.RemoveImage(repoName, false)
+	c.Assert(err, checker.IsNil)
+	_, err = s.d.PullImage(repoName)
+	c.Assert(err, checker.IsNil)
+}
+
+func (s *DockerRegistrySuite) TestDaemonWaitForImage(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	repoName := fmt.Sprintf("%v/dockercli/waitforimage", privateRegistryURL)
+	c.Assert(s.d.TagImage("busybox", repoName), checker.IsNil)
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+	_, err := s.d.RemoveImage(repoName, false)
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.WaitForImage(repoName, time.Second), checker.NotNil)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.d.PullImage(repoName)
+		errCh <- err
+	}()
+	c.Assert(s.d.WaitForImage(repoName, 30*time.Second), checker.IsNil)
+	out, err := s.d.Cmd("run", "--rm", repoName, "true")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	c.Assert(<-errCh, checker.IsNil)
+}
+
+func (s *DockerRegistrySuite) TestDaemonImageDigest(c *check.C) {
+	defer s.d.Cleanup()
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	repoName := fmt.Sprintf("%v/dockercli/digest", privateRegistryURL)
+	c.Assert(s.d.TagImage("busybox", repoName), checker.IsNil)
+	_, err := s.d.ImageDigest(repoName)
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "no repository digest")
+	configDigest, err := s.d.ImageConfigDigest(repoName)
+	c.Assert(err, checker.IsNil)
+
+	out, err := s.d.Cmd("push", repoName)
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	matches := pushDigestRegex.FindStringSubmatch(out)
+	c.Assert(matches, checker.HasLen, 2, check.Commentf("no digest in push output: %s", out))
+	byDigest := repoName + "@" + matches[1]
+
+	d := NewDaemon(c)
+	c.Assert(d.Start(), checker.IsNil)
+	defer d.Stop()
+	_, err = d.PullImage(byDigest)
+	c.Assert(err, checker.IsNil)
+	repoDigest, err := d.ImageDigest(byDigest)
+	c.Assert(err, checker.IsNil)
+	c.Assert(repoDigest, checker.Equals, byDigest)
+	pulledDigest, err := d.ImageConfigDigest(byDigest)
+	c.Assert(err, checker.IsNil)
+	c.Assert(pulledDigest, checker.Equals, configDigest)
+}
+
+func (s *DockerRegistrySuite) TestDaemonMaxConcurrentDownloads(c *check.C) {
+	s.d.MaxConcurrentDownloads = 1
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+	c.Assert(strings.Join(s.d.cmd.Args, " "), checker.Contains, "--max-concurrent-downloads 1")
+	c.Assert(strings.Join(s.d.cmd.Args, " "), checker.Not(checker.Contains), "--max-concurrent-uploads")
+
+	repoName := fmt.Sprintf("%v/dockercli/layers", privateRegistryURL)
+	_, err := s.d.BuildNoCache(repoName, "FROM busybox\nRUN echo 1 > /1\nRUN echo 2 > /2\nRUN echo 3 > /3")
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+	_, err = s.d.RemoveImage(repoName, false)
+	c.Assert(err, checker.IsNil)
+	_, err = s.d.RemoveImage("busybox", true)
+	c.Assert(err, checker.IsNil)
+
+	messages, err := s.d.PullImageWithProgress(context.Background(), repoName)
+	c.Assert(err, checker.IsNil)
+
+	// a layer downloads from its first progress until "Download complete"
+	var (
+		downloading = map[string]bool{}
+		waited      = map[string]bool{}
+		maxParallel int
+	)
+	for m := range messages {
+		c.Assert(m.Error, checker.IsNil)
+		switch m.Status {
+		case "Waiting":
+			waited[m.ID] = true
+		case "Downloading", "Verifying Checksum":
+			downloading[m.ID] = true
+		case "Download complete":
+			downloading[m.ID] = true
+			if len(downloading) > maxParallel {
+				maxParallel = len(downloading)
+			}
+			delete(downloading, m.ID)
+			continue
+		}
+		if len(downloading) > maxParallel {
+			maxParallel = len(downloading)
+		}
+	}
+	c.Assert(maxParallel, checker.Equals, 1)
+	// busybox and the three RUN layers can't all start at once
+	c.Assert(len(waited) >= 3, checker.True, check.Commentf("%d layers waited", len(waited)))
+}
+
+func (s *DockerRegistrySuite) TestDaemonPullImageWithProgress(c *check.C) {
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	repoName := fmt.Sprintf("%v/dockercli/progress", privateRegistryURL)
+	_, err := s.d.BuildNoCache(repoName, "FROM busybox\nRUN echo 1 > /1\nRUN echo 2 > /2")
+	c.Assert(err, checker.IsNil)
+	c.Assert(s.d.PushImage(repoName), checker.IsNil)
+
+	d := NewDaemon(c)
+	c.Assert(d.Start(), checker.IsNil)
+	defer d.Stop()
+	messages, err := d.PullImageWithProgress(context.Background(), repoName)
+	c.Assert(err, checker.IsNil)
+	layers := map[string]bool{}
+	for m := range messages {
+		c.Assert(m.Error, checker.IsNil)
+		if m.Status == "Pull complete" {
+			layers[m.ID] = true
+		}
+	}
+	// busybox and the two RUN layers
+	c.Assert(layers, checker.HasLen, 3)
+
+	// the daemon answers with an error status if it fails before writing
+	// any progress, otherwise the error ends the stream
+	messages, err = d.PullImageWithProgress(context.Background(), privateRegistryURL+"/dockercli/doesnotexist")
+	if err == nil {
+		var last jsonmessage.JSONMessage
+		for m := range messages {
+			last = m
+		}
+		c.Assert(last.Error, checker.NotNil)
+		err = last.Error
+	}
+	c.Assert(err, checker.NotNil)
+	c.Assert(err.Error(), checker.Contains, "not found")
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/docker/docker/pkg/integration/checker"
 	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
 	"github.com/go-check/check"
 )
 
@@ -215,3 +216,24 @@ func (s *DockerSuite) TestUpdateStats(c *check.C) {
 	c.Assert(preMemLimit, checker.Equals, curMemLimit)
 
 }
+
+func (s *DockerDaemonSuite) TestDaemonUpdateContainer(c *check.C) {
+	testRequires(c, memoryLimitSupport)
+	c.Assert(s.d.StartWithBusybox(), checker.IsNil)
+
+	out, err := s.d.Cmd("run", "-d", "-m", "300M", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf(out))
+	id := strings.TrimSpace(out)
+
+	c.Assert(s.d.UpdateContainer(id, "-m", "500M"), checker.IsNil)
+	ctr, err := s.d.InspectContainer(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(ctr.HostConfig.Memory, checker.Equals, int64(524288000))
+
+	var update container.UpdateConfig
+	update.Memory = 629145600
+	c.Assert(s.d.UpdateContainerResources(id, update), checker.IsNil)
+	ctr, err = s.d.InspectContainer(id)
+	c.Assert(err, checker.IsNil)
+	c.Assert(ctr.HostConfig.Memory, checker.Equals, int64(629145600))
+}
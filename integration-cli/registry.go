@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/docker/distribution/digest"
 	"github.com/go-check/check"
@@ -173,3 +177,152 @@ func (t *testRegistryV2) tempMoveBlobData(c *check.C, blobDigest digest.Digest)
 		os.Remove(tempFile.Name())
 	}
 }
+
+// Registry is a registry:2 container run on the host daemon by
+// NewV2Registry.
+type Registry struct {
+	// Addr is the host:port the registry is published on, to be used as the
+	// prefix of image references.
+	Addr string
+	// Username and Password are the credentials of the registry user, if
+	// it was started WithRegistryAuth.
+	Username string
+	Password string
+
+	container string
+	dir       string
+	tls       bool
+}
+
+// RegistryOpt configures the registry started by NewV2Registry.
+type RegistryOpt func(*Registry)
+
+// WithRegistryAuth requires htpasswd authentication as testuser with the
+// password testpassword.
+func WithRegistryAuth() RegistryOpt {
+	return func(r *Registry) {
+		r.Username = "testuser"
+		r.Password = "testpassword"
+	}
+}
+
+// WithRegistryTLS serves the registry over https with the localhost
+// certificate of the notary fixtures. Daemons have to treat the registry as
+// insecure or trust that certificate.
+func WithRegistryTLS() RegistryOpt {
+	return func(r *Registry) {
+		r.tls = true
+	}
+}
+
+// NewV2Registry runs a registry on the host daemon, published on a free
+// loopback port, and waits until it serves requests. The test is skipped if
+// the registry image is not available. The host daemon has to be local, as
+// the registry configuration is bind mounted into the container.
+func NewV2Registry(c *check.C, opts ...RegistryOpt) (*Registry, error) {
+	image := registryImageName
+	if !strings.Contains(path.Base(image), ":") {
+		image += ":2"
+	}
+	if _, _, err := dockerCmdWithError("inspect", "--type", "image", image); err != nil {
+		if out, _, err := dockerCmdWithError("pull", image); err != nil {
+			c.Skip(fmt.Sprintf("registry image %s not available: %s", image, out))
+		}
+	}
+
+	r := &Registry{}
+	for _, o := range opts {
+		o(r)
+	}
+	dir, err := ioutil.TempDir("", "registry-")
+	if err != nil {
+		return nil, err
+	}
+	r.dir = dir
+
+	args := []string{"run", "-d", "-p", "127.0.0.1::5000", "-v", dir + ":/config:ro"}
+	if r.Username != "" {
+		// generated with: htpasswd -Bbn testuser testpassword
+		userpasswd := "testuser:$2y$05$sBsSqk0OpSD1uTZkHXc4FeJ0Z70wLQdAX/82UiHuQOKbNbBrzs63m"
+		if err := ioutil.WriteFile(filepath.Join(dir, "htpasswd"), []byte(userpasswd), 0644); err != nil {
+			r.Close()
+			return nil, err
+		}
+		args = append(args,
+			"-e", "REGISTRY_AUTH=htpasswd",
+			"-e", "REGISTRY_AUTH_HTPASSWD_REALM=basic-realm",
+			"-e", "REGISTRY_AUTH_HTPASSWD_PATH=/config/htpasswd")
+	}
+	if r.tls {
+		for _, f := range []string{"localhost.cert", "localhost.key"} {
+			b, err := ioutil.ReadFile(filepath.Join("fixtures", "notary", f))
+			if err == nil {
+				err = ioutil.WriteFile(filepath.Join(dir, f), b, 0644)
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		args = append(args,
+			"-e", "REGISTRY_HTTP_TLS_CERTIFICATE=/config/localhost.cert",
+			"-e", "REGISTRY_HTTP_TLS_KEY=/config/localhost.key")
+	}
+	out, _, err := dockerCmdWithError(append(args, image)...)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("could not run registry: %v\n%s", err, out)
+	}
+	r.container = strings.TrimSpace(out)
+
+	out, _, err = dockerCmdWithError("port", r.container, "5000")
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("could not get the registry port: %v\n%s", err, out)
+	}
+	r.Addr = strings.TrimSpace(out)
+
+	for i := 0; i != 50; i++ {
+		if err = r.Ping(); err == nil {
+			return r, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	r.Close()
+	return nil, fmt.Errorf("timeout waiting for registry at %s: %v", r.Addr, err)
+}
+
+// Ping checks that the registry serves the v2 API.
+func (r *Registry) Ping() error {
+	scheme := "http"
+	client := &http.Client{}
+	if r.tls {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Get(fmt.Sprintf("%s://%s/v2/", scheme, r.Addr))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// unauthorized is a _good_ status when pinging v2/ and it needs auth
+	if resp.StatusCode != http.StatusOK && (r.Username == "" || resp.StatusCode != http.StatusUnauthorized) {
+		return fmt.Errorf("registry ping replied with an unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close removes the registry container and its configuration.
+func (r *Registry) Close() error {
+	var err error
+	if r.container != "" {
+		if out, _, rmErr := dockerCmdWithError("rm", "-fv", r.container); rmErr != nil {
+			err = fmt.Errorf("could not remove registry %s: %v\n%s", r.container, rmErr, out)
+		}
+	}
+	if rmErr := os.RemoveAll(r.dir); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}